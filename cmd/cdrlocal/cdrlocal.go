@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 
+	"github.com/OliverQin/cedar/libcedar/bundle"
 	"github.com/OliverQin/cedar/libcedar/proxy"
 	"github.com/OliverQin/cedar/libcedar/socks"
 )
@@ -25,7 +27,15 @@ type cedarClientConfig struct {
 	Local      string
 	Remote     string
 	Password   string
+	Cipher     string
+	KDF        string
+	KDFSalt    string
+	User       string
 	BufferSize int
+	MinBuffer  int
+	RateLimit  int
+	MaxRate    int
+	RateJitter float64
 	NumOfConns int
 }
 
@@ -34,7 +44,15 @@ func main() {
 	var localAddr string
 	var remoteAddr string
 	var password string
+	var cipherName string
+	var kdfNames string
+	var kdfSalt string
+	var userID string
 	var bufferSize int
+	var minBuffer int
+	var rateLimit int
+	var maxRate int
+	var rateJitter float64
 	var configFilename string
 	var numOfConns int
 
@@ -42,8 +60,16 @@ func main() {
 	flag.BoolVar(&helpInfo, "h", false, "Display help info.")
 	flag.StringVar(&localAddr, "s", "127.0.0.1:1080", "Local address and port like \"127.0.0.1:1080\".")
 	flag.StringVar(&password, "p", "123456", "Password for encryption")
+	flag.StringVar(&cipherName, "e", bundle.CipherCedar, "Cipher for encryption: "+bundle.CipherCedar+" (legacy), "+bundle.CipherAESGCM+" or "+bundle.CipherChaCha20Poly1305+". Must be the same on both sides.")
+	flag.StringVar(&kdfNames, "k", bundle.KDFSimple, "KDF of keys from password, separated by comma: "+bundle.KDFArgon2id+", "+bundle.KDFScrypt+" or "+bundle.KDFSimple+" (legacy). The first one is used.")
+	flag.StringVar(&kdfSalt, "t", "", "Salt of KDF, required by "+bundle.KDFArgon2id+" and "+bundle.KDFScrypt+". Use a random one for each deployment, the same on both sides.")
+	flag.StringVar(&userID, "u", "", "User ID of a multi-user server, whose secret is the password. It is never sent.")
 	flag.StringVar(&configFilename, "c", "", "Filename of config file. It overwrites command line parameters.")
 	flag.IntVar(&bufferSize, "b", 100, "Max number of buffers. Size of each buffer is "+strconv.Itoa(socks.DefaultBufferLength)+"B.")
+	flag.IntVar(&minBuffer, "a", 0, "Min number of buffers. If set, number of buffers is adjusted automatically between it and the max.")
+	flag.IntVar(&rateLimit, "l", 0, "Rate limit of each TCP connection, in KB/s. 0 means unlimited.")
+	flag.IntVar(&maxRate, "m", 0, "Max rate of each TCP connection with jitter, in KB/s. 0 means same as rate limit.")
+	flag.Float64Var(&rateJitter, "j", 0, "Random variation of rate limit, from 0 to 1.")
 	flag.IntVar(&numOfConns, "n", 10, "Number of TCP connections.")
 
 	flag.Parse()
@@ -66,6 +92,18 @@ func main() {
 		if conf.Password != "" {
 			password = conf.Password
 		}
+		if conf.Cipher != "" {
+			cipherName = conf.Cipher
+		}
+		if conf.KDF != "" {
+			kdfNames = conf.KDF
+		}
+		if conf.KDFSalt != "" {
+			kdfSalt = conf.KDFSalt
+		}
+		if conf.User != "" {
+			userID = conf.User
+		}
 		if conf.Remote != "" {
 			remoteAddr = conf.Remote
 		}
@@ -75,16 +113,55 @@ func main() {
 		if conf.BufferSize != 0 {
 			bufferSize = conf.BufferSize
 		}
+		if conf.MinBuffer != 0 {
+			minBuffer = conf.MinBuffer
+		}
+		if conf.RateLimit != 0 {
+			rateLimit = conf.RateLimit
+		}
+		if conf.MaxRate != 0 {
+			maxRate = conf.MaxRate
+		}
+		if conf.RateJitter != 0 {
+			rateJitter = conf.RateJitter
+		}
 		if conf.NumOfConns != 0 {
 			numOfConns = conf.NumOfConns
 		}
 	}
 
+	if !bundle.IsCipherSupported(cipherName) {
+		fmt.Fprintf(os.Stderr, "Error: unknown cipher %s.\n", cipherName)
+		os.Exit(1)
+	}
+	kdfs := make([]bundle.KDF, 0)
+	for _, name := range strings.Split(kdfNames, ",") {
+		kdf, err := bundle.NewKDF(strings.TrimSpace(name), kdfSalt)
+		if err == bundle.ErrNoKDFSalt {
+			fmt.Fprintf(os.Stderr, "Error: KDF %s needs salt, set it by \"-t <salt>\".\n", name)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unknown KDF %s.\n", name)
+			os.Exit(1)
+		}
+		kdfs = append(kdfs, kdf)
+	}
 	fmt.Fprintln(os.Stderr, "Remote: ", remoteAddr)
 	fmt.Fprintln(os.Stderr, "Local:", localAddr)
 	fmt.Fprintln(os.Stderr, "Running...")
 
-	clt := proxy.NewProxyLocal(password, remoteAddr, localAddr, bufferSize)
+	clt := proxy.NewProxyLocal(password, cipherName, remoteAddr, localAddr, bufferSize)
+	clt.SetKDF(kdfs...)
+	if userID != "" {
+		clt.SetUser(userID)
+	}
+	if minBuffer != 0 {
+		clt.SetAutoBuffer(minBuffer)
+	}
+	if rateLimit != 0 {
+		clt.SetRateLimit(int64(rateLimit)*1024, int64(maxRate)*1024, rateJitter)
+	}
 	clt.Run(numOfConns)
 
 	blocker := make(chan int)
@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 
+	"github.com/OliverQin/cedar/libcedar/bundle"
 	"github.com/OliverQin/cedar/libcedar/proxy"
 	"github.com/OliverQin/cedar/libcedar/socks"
 )
@@ -24,21 +26,45 @@ func PrintUsage() {
 type cedarServerConfig struct {
 	Remote     string
 	Password   string
+	Cipher     string
+	KDF        string
+	KDFSalt    string
+	Users      string
 	BufferSize int
+	MinBuffer  int
+	RateLimit  int
+	MaxRate    int
+	RateJitter float64
 }
 
 func main() {
 	var helpInfo bool
 	var remoteAddr string
 	var password string
+	var cipherName string
+	var kdfNames string
+	var kdfSalt string
+	var usersFilename string
 	var bufferSize int
+	var minBuffer int
+	var rateLimit int
+	var maxRate int
+	var rateJitter float64
 	var configFilename string
 
 	flag.BoolVar(&helpInfo, "h", false, "Display help info.")
 	flag.StringVar(&remoteAddr, "s", "127.0.0.1:41289", "Remote (cdrserver) address and port, like \"127.0.0.1:41289\".")
 	flag.StringVar(&password, "p", "123456", "Password for encryption.")
+	flag.StringVar(&cipherName, "e", bundle.CipherCedar, "Cipher for encryption: "+bundle.CipherCedar+" (legacy), "+bundle.CipherAESGCM+" or "+bundle.CipherChaCha20Poly1305+". Must be the same on both sides.")
+	flag.StringVar(&kdfNames, "k", bundle.KDFSimple, "KDF of keys from password, separated by comma: "+bundle.KDFArgon2id+", "+bundle.KDFScrypt+" or "+bundle.KDFSimple+" (legacy). All of them are accepted.")
+	flag.StringVar(&kdfSalt, "t", "", "Salt of KDF, required by "+bundle.KDFArgon2id+" and "+bundle.KDFScrypt+". Use a random one for each deployment, the same on both sides.")
+	flag.StringVar(&usersFilename, "u", "", "Filename of users file, a JSON object of secrets by user IDs, like {\"alice\": \"secret\"}. If set, password is not used, and each client connects as a user.")
 	flag.StringVar(&configFilename, "c", "", "Filename of config file. It overwrites command line parameters.")
 	flag.IntVar(&bufferSize, "b", 100, "Max number of buffers. Size of each buffer is "+strconv.Itoa(socks.DefaultBufferLength)+"B.")
+	flag.IntVar(&minBuffer, "a", 0, "Min number of buffers. If set, number of buffers is adjusted automatically between it and the max.")
+	flag.IntVar(&rateLimit, "l", 0, "Rate limit of each TCP connection, in KB/s. 0 means unlimited.")
+	flag.IntVar(&maxRate, "m", 0, "Max rate of each TCP connection with jitter, in KB/s. 0 means same as rate limit.")
+	flag.Float64Var(&rateJitter, "j", 0, "Random variation of rate limit, from 0 to 1.")
 
 	flag.Parse()
 
@@ -60,14 +86,67 @@ func main() {
 		if conf.Password != "" {
 			password = conf.Password
 		}
+		if conf.Cipher != "" {
+			cipherName = conf.Cipher
+		}
+		if conf.KDF != "" {
+			kdfNames = conf.KDF
+		}
+		if conf.KDFSalt != "" {
+			kdfSalt = conf.KDFSalt
+		}
+		if conf.Users != "" {
+			usersFilename = conf.Users
+		}
 		if conf.Remote != "" {
 			remoteAddr = conf.Remote
 		}
 		if conf.BufferSize != 0 {
 			bufferSize = conf.BufferSize
 		}
+		if conf.MinBuffer != 0 {
+			minBuffer = conf.MinBuffer
+		}
+		if conf.RateLimit != 0 {
+			rateLimit = conf.RateLimit
+		}
+		if conf.MaxRate != 0 {
+			maxRate = conf.MaxRate
+		}
+		if conf.RateJitter != 0 {
+			rateJitter = conf.RateJitter
+		}
 	}
 
+	if !bundle.IsCipherSupported(cipherName) {
+		fmt.Fprintf(os.Stderr, "Error: unknown cipher %s.\n", cipherName)
+		os.Exit(1)
+	}
+	kdfs := make([]bundle.KDF, 0)
+	for _, name := range strings.Split(kdfNames, ",") {
+		kdf, err := bundle.NewKDF(strings.TrimSpace(name), kdfSalt)
+		if err == bundle.ErrNoKDFSalt {
+			fmt.Fprintf(os.Stderr, "Error: KDF %s needs salt, set it by \"-t <salt>\".\n", name)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: unknown KDF %s.\n", name)
+			os.Exit(1)
+		}
+		kdfs = append(kdfs, kdf)
+	}
+	var users map[string]string
+	if usersFilename != "" {
+		data, err := ioutil.ReadFile(usersFilename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot load users file.\n")
+			os.Exit(1)
+		}
+		if err := json.Unmarshal(data, &users); err != nil || len(users) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: users file should be a JSON object of secrets by user IDs.\n")
+			os.Exit(1)
+		}
+	}
 	if remoteAddr == "" {
 		fmt.Fprintf(os.Stderr, "Error: serviceString is empty.\n")
 		fmt.Fprintf(os.Stderr, "Try using \"-s <service string>\" flag.\n")
@@ -80,6 +159,16 @@ func main() {
 		panic("stop")
 	}()*/
 
-	server := proxy.NewProxyServer(password, remoteAddr, bufferSize)
+	server := proxy.NewProxyServer(password, cipherName, remoteAddr, bufferSize)
+	server.SetKDF(kdfs...)
+	if users != nil {
+		server.SetUsers(users)
+	}
+	if minBuffer != 0 {
+		server.SetAutoBuffer(minBuffer)
+	}
+	if rateLimit != 0 {
+		server.SetRateLimit(int64(rateLimit)*1024, int64(maxRate)*1024, rateJitter)
+	}
 	server.Run()
 }
@@ -0,0 +1,311 @@
+package bundle
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/*
+Names of ciphers, used to select CryptoIO. Both sides must use the same one.
+CipherCedar is the legacy one, kept for old peers.
+*/
+const (
+	CipherCedar            = "cedar"
+	CipherAESGCM           = "aes-256-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+/*
+ErrUnknownCipher is returned when a cipher is not supported.
+*/
+var ErrUnknownCipher = errors.New("unknown cipher")
+
+/*
+IsCipherSupported tells if NewCryptoIO accepts cipherName.
+*/
+func IsCipherSupported(cipherName string) bool {
+	switch cipherName {
+	case CipherCedar, CipherAESGCM, CipherChaCha20Poly1305, "":
+		return true
+	}
+	return false
+}
+
+/*
+NewCryptoIO creates CryptoIO of cipher, with keys from password by SimpleKDF. "" means CipherCedar.
+*/
+func NewCryptoIO(cipherName string, password string) (CryptoIO, error) {
+	return NewCryptoIOWithKDF(cipherName, password, SimpleKDF{})
+}
+
+/*
+NewCryptoIOWithKDF creates CryptoIO of cipher, with keys from password by kdf. "" means CipherCedar.
+*/
+func NewCryptoIOWithKDF(cipherName string, password string, kdf KDF) (CryptoIO, error) {
+	switch cipherName {
+	case CipherCedar, "":
+		return NewCedarCryptoIOWithKDF(password, kdf), nil
+	case CipherAESGCM:
+		return newAEADCryptoIO(CipherAESGCM, newAESGCM, password, kdf), nil
+	case CipherChaCha20Poly1305:
+		return newAEADCryptoIO(CipherChaCha20Poly1305, chacha20poly1305.New, password, kdf), nil
+	}
+	return nil, ErrUnknownCipher
+}
+
+/*
+AEADCryptoIO is CryptoIO based on an AEAD, like AES-GCM and ChaCha20-Poly1305.
+*/
+type AEADCryptoIO struct {
+	name    string
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	aead    cipher.AEAD
+	label   []byte //associated data of header
+	kdf     KDF    //of SetKey
+
+	maxFrame uint32 //max length of message in a packet
+	scratch  sync.Pool
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+NewAESGCMCryptoIO creates a new AEADCryptoIO of AES-256-GCM, with key from password by SimpleKDF.
+*/
+func NewAESGCMCryptoIO(password string) *AEADCryptoIO {
+	return newAEADCryptoIO(CipherAESGCM, newAESGCM, password, SimpleKDF{})
+}
+
+/*
+NewChaCha20Poly1305CryptoIO creates a new AEADCryptoIO of ChaCha20-Poly1305, with key from password by SimpleKDF.
+*/
+func NewChaCha20Poly1305CryptoIO(password string) *AEADCryptoIO {
+	return newAEADCryptoIO(CipherChaCha20Poly1305, chacha20poly1305.New, password, SimpleKDF{})
+}
+
+func newAEADCryptoIO(name string, newAEAD func([]byte) (cipher.AEAD, error), password string, kdf KDF) *AEADCryptoIO {
+	ret := new(AEADCryptoIO)
+	ret.name = name
+	ret.newAEAD = newAEAD
+	ret.label = []byte("cedar/" + name)
+	ret.kdf = kdf
+	ret.SetKey(password)
+	ret.SetMaxFrameSize(0)
+
+	return ret
+}
+
+/*
+SetKey sets password for AEADCryptoIO.
+*/
+func (ae *AEADCryptoIO) SetKey(password string) {
+	ae.setKey(ae.kdf.Generate(password, "cedar/"+ae.name+"/key", 256))
+}
+
+/*
+Derive returns a new AEADCryptoIO of the same cipher, whose key is derived from key of a session, instead of password.
+*/
+func (ae *AEADCryptoIO) Derive(key []byte) CryptoIO {
+	ret := new(AEADCryptoIO)
+	ret.name = ae.name
+	ret.newAEAD = ae.newAEAD
+	ret.label = ae.label
+	ret.kdf = ae.kdf
+	ret.setKey(expandKey(key, "cedar/"+ae.name+"/key", 256))
+	ret.maxFrame = ae.maxFrame
+
+	return ret
+}
+
+func (ae *AEADCryptoIO) setKey(key []byte) {
+	aead, err := ae.newAEAD(key)
+	if err != nil {
+		panic("cannot create AEAD: " + err.Error())
+	}
+	ae.aead = aead
+}
+
+/*
+SetMaxFrameSize sets the max length of message in a packet, 0 means the default.
+Larger packets are refused before anything is allocated for them.
+*/
+func (ae *AEADCryptoIO) SetMaxFrameSize(size int) {
+	if size <= 0 {
+		size = globalMaxFrame
+	}
+	ae.maxFrame = uint32(size)
+}
+
+/*
+Packet format of AEADCryptoIO:
+
+	[nonce xB]([timestamp 4B][length 4B])[tag]([message xB])[tag]
+
+Parts in brackets are sealed separately, so that length is known before the message is read.
+Nonce is random, with the lowest bit cleared for header, and set for message.
+Header is sealed with name of the cipher and position of the packet (if any, see SequencedIO) as associated data,
+message with header sealed.
+*/
+const aeadHeadLen = 4 + 4
+
+/*
+aeadScratch is state reused for writing or reading packets, so that they do not allocate.
+*/
+type aeadScratch struct {
+	nonce []byte //nonce of message
+	head  []byte //header read
+	plain []byte //header opened
+	label []byte //associated data of header
+}
+
+func (ae *AEADCryptoIO) getScratch() *aeadScratch {
+	if v := ae.scratch.Get(); v != nil {
+		return v.(*aeadScratch)
+	}
+	sc := new(aeadScratch)
+	sc.nonce = make([]byte, ae.aead.NonceSize())
+	sc.head = make([]byte, ae.FrameHead())
+	sc.plain = make([]byte, 0, aeadHeadLen)
+	sc.label = make([]byte, 0, len(ae.label)+recordPositionLen)
+	return sc
+}
+
+/*
+headLabel returns associated data of header at position, in sc.
+*/
+func (ae *AEADCryptoIO) headLabel(sc *aeadScratch, position []byte) []byte {
+	sc.label = append(append(sc.label[:0], ae.label...), position...)
+	return sc.label
+}
+
+func (ae *AEADCryptoIO) putScratch(sc *aeadScratch) {
+	ae.scratch.Put(sc)
+}
+
+/*
+FrameHead returns bytes reserved before the message in a frame.
+*/
+func (ae *AEADCryptoIO) FrameHead() int {
+	return ae.aead.NonceSize() + aeadHeadLen + ae.aead.Overhead()
+}
+
+/*
+FrameTail returns bytes reserved after the message in a frame.
+*/
+func (ae *AEADCryptoIO) FrameTail() int {
+	return ae.aead.Overhead()
+}
+
+/*
+WritePacket writes a block of encrypted message to conn.
+It returns the size actually wrote (larger than len(msg)) and error.
+*/
+func (ae *AEADCryptoIO) WritePacket(conn io.ReadWriter, msg []byte) (int, error) {
+	head := ae.FrameHead()
+	buf := getBuffer(head + len(msg) + ae.FrameTail())
+	defer buf.release()
+
+	copy(buf.bytes[head:], msg)
+	return ae.WriteFrame(conn, buf.bytes, len(msg))
+}
+
+/*
+WriteFrame encrypts frame in place, and writes it to conn.
+Message of msgLen bytes is after FrameHead bytes in frame, and frame has FrameTail bytes after it.
+It returns the size actually wrote and error.
+*/
+func (ae *AEADCryptoIO) WriteFrame(conn io.Writer, frame []byte, msgLen int) (int, error) {
+	return ae.WriteFrameAt(conn, frame, msgLen, nil)
+}
+
+/*
+WriteFrameAt is WriteFrame of a packet at position of a stream, see SequencedIO.
+*/
+func (ae *AEADCryptoIO) WriteFrameAt(conn io.Writer, frame []byte, msgLen int, position []byte) (int, error) {
+	if uint64(msgLen) > uint64(ae.maxFrame) {
+		return 0, ErrFrameTooLarge
+	}
+
+	sc := ae.getScratch()
+	defer ae.putScratch(sc)
+
+	nonceLen := ae.aead.NonceSize()
+	head := ae.FrameHead()
+
+	nonce := frame[0:nonceLen]
+	DefaultRNG.Read(nonce)
+	nonce[nonceLen-1] &^= 1
+	copy(sc.nonce, nonce)
+	sc.nonce[nonceLen-1] |= 1
+
+	binary.BigEndian.PutUint32(frame[nonceLen:nonceLen+4], timestamp())
+	binary.BigEndian.PutUint32(frame[nonceLen+4:nonceLen+8], uint32(msgLen))
+	ae.aead.Seal(frame[nonceLen:nonceLen], nonce, frame[nonceLen:nonceLen+aeadHeadLen], ae.headLabel(sc, position))
+	ae.aead.Seal(frame[head:head], sc.nonce, frame[head:head+msgLen], frame[nonceLen:head])
+
+	return conn.Write(frame[:head+msgLen+ae.FrameTail()])
+}
+
+/*
+ReadPacket reads a packet of encrypted message from conn.
+It returns the []byte got and error.
+When any error occur, the []byte returned is nil.
+*/
+func (ae *AEADCryptoIO) ReadPacket(conn io.ReadWriter) ([]byte, error) {
+	return ae.ReadPacketAt(conn, nil)
+}
+
+/*
+ReadPacketAt is ReadPacket of a packet at position of a stream, see SequencedIO.
+*/
+func (ae *AEADCryptoIO) ReadPacketAt(conn io.ReadWriter, position []byte) ([]byte, error) {
+	sc := ae.getScratch()
+	defer ae.putScratch(sc)
+
+	_, err := io.ReadFull(conn, sc.head)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceLen := ae.aead.NonceSize()
+	nonce := sc.head[0:nonceLen]
+	if nonce[nonceLen-1]&1 != 0 {
+		return nil, ErrIllegalPacket
+	}
+	plain, err := ae.aead.Open(sc.plain[:0], nonce, sc.head[nonceLen:], ae.headLabel(sc, position))
+	if err != nil || !timeMatch(binary.BigEndian.Uint32(plain[0:4])) {
+		return nil, ErrIllegalPacket
+	}
+
+	msgLen := binary.BigEndian.Uint32(plain[4:8])
+	if msgLen > ae.maxFrame {
+		return nil, ErrFrameTooLarge
+	}
+
+	//the only allocation, message returned is in it
+	sealed := make([]byte, int(msgLen)+ae.FrameTail())
+	_, err = io.ReadFull(conn, sealed)
+	if err != nil {
+		return nil, ErrIllegalPacket
+	}
+
+	copy(sc.nonce, nonce)
+	sc.nonce[nonceLen-1] |= 1
+	msg, err := ae.aead.Open(sealed[:0], sc.nonce, sealed, sc.head[nonceLen:])
+	if err != nil {
+		return nil, ErrIllegalPacket
+	}
+	return msg, nil
+}
@@ -0,0 +1,154 @@
+package bundle
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testAEADEncryptor(encryptor *AEADCryptoIO) {
+	frw := bytes.NewBuffer(nil)
+	for i := 0; i < 300; i += 7 {
+		msg := make([]byte, i)
+		DefaultRNG.Read(msg)
+
+		encryptor.WritePacket(frw, msg)
+		p, err := encryptor.ReadPacket(frw)
+		if err != nil {
+			panic(err.Error())
+		}
+		if !bytes.Equal(msg, p) {
+			panic("message changed after enc/dec")
+		}
+	}
+
+	//any byte changed, packet is refused
+	msg := []byte("hello, cedar")
+	encryptor.WritePacket(frw, msg)
+	packet := append([]byte{}, frw.Bytes()...)
+	frw.Reset()
+	for i := range packet {
+		tampered := append([]byte{}, packet...)
+		tampered[i] ^= 0x10
+		if _, err := encryptor.ReadPacket(bytes.NewBuffer(tampered)); err == nil {
+			panic("tampered packet should be refused")
+		}
+	}
+}
+
+func TestAEADEncryptor(t *testing.T) {
+	testAEADEncryptor(NewAESGCMCryptoIO("test_test_test"))
+	testAEADEncryptor(NewChaCha20Poly1305CryptoIO("test_test_test"))
+
+	//different cipher or password, packet is refused
+	frw := bytes.NewBuffer(nil)
+	NewAESGCMCryptoIO("test_test_test").WritePacket(frw, []byte("hello"))
+	if _, err := NewChaCha20Poly1305CryptoIO("test_test_test").ReadPacket(frw); err == nil {
+		panic("packet of another cipher should be refused")
+	}
+	NewAESGCMCryptoIO("test_test_test").WritePacket(frw, []byte("hello"))
+	if _, err := NewAESGCMCryptoIO("test").ReadPacket(frw); err == nil {
+		panic("packet of another password should be refused")
+	}
+
+	if _, err := NewCryptoIO("rot13", "test"); err != ErrUnknownCipher || IsCipherSupported("rot13") {
+		panic("unknown cipher should be refused")
+	}
+}
+
+func TestAEADEncryptorPosition(t *testing.T) {
+	encryptor := NewChaCha20Poly1305CryptoIO("test_test_test")
+	fbs := []*Fiber{{stream: 1}, {stream: 2}}
+	var buf [recordPositionLen]byte
+
+	//packet i of stream s is written at position i
+	packets := make([][][]byte, len(fbs))
+	for s, fb := range fbs {
+		for i := 0; i < 3; i++ {
+			frame := make([]byte, encryptor.FrameHead()+1+encryptor.FrameTail())
+			frame[encryptor.FrameHead()] = byte(i)
+			frw := bytes.NewBuffer(nil)
+			encryptor.WriteFrameAt(frw, frame, 1, fb.position(&buf, true, uint64(i)))
+			packets[s] = append(packets[s], frw.Bytes())
+		}
+	}
+
+	read := func(packet []byte, fb *Fiber, fromClient bool, seq uint64) error {
+		_, err := encryptor.ReadPacketAt(bytes.NewBuffer(packet), fb.position(&buf, fromClient, seq))
+		return err
+	}
+	if read(packets[0][1], fbs[0], true, 1) != nil {
+		panic("packet at its position should be accepted")
+	}
+	if read(packets[0][1], fbs[0], true, 2) == nil || read(packets[0][1], fbs[0], true, 0) == nil {
+		panic("packet replayed, dropped or reordered should be refused")
+	}
+	if read(packets[0][1], fbs[1], true, 1) == nil {
+		panic("packet of another stream should be refused")
+	}
+	if read(packets[0][1], fbs[0], false, 1) == nil {
+		panic("packet of another direction should be refused")
+	}
+	if _, err := encryptor.ReadPacket(bytes.NewBuffer(packets[0][0])); err == nil {
+		panic("packet at a position should be refused without it")
+	}
+}
+
+func TestAEADEncryptorFrameSize(t *testing.T) {
+	writer := NewAESGCMCryptoIO("test_test_test")
+	reader := NewAESGCMCryptoIO("test_test_test")
+	reader.SetMaxFrameSize(100)
+
+	frw := bytes.NewBuffer(nil)
+	writer.WritePacket(frw, make([]byte, 1000))
+	if _, err := reader.ReadPacket(frw); err != ErrFrameTooLarge {
+		panic("large frame should be refused")
+	}
+
+	writer.SetMaxFrameSize(100)
+	if _, err := writer.WritePacket(frw, make([]byte, 101)); err != ErrFrameTooLarge {
+		panic("large frame should not be written")
+	}
+}
+
+func benchmarkAEADWriteFrame(b *testing.B, encryptor *AEADCryptoIO) {
+	frame := make([]byte, encryptor.FrameHead()+benchmarkMessageLen+encryptor.FrameTail())
+	conn := new(replayConn)
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkMessageLen)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encryptor.WriteFrame(conn, frame, benchmarkMessageLen)
+	}
+}
+
+func benchmarkAEADReadPacket(b *testing.B, encryptor *AEADCryptoIO) {
+	frw := bytes.NewBuffer(nil)
+	encryptor.WritePacket(frw, make([]byte, benchmarkMessageLen))
+	conn := &replayConn{frw.Bytes(), 0}
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkMessageLen)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encryptor.ReadPacket(conn); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkAESGCMWriteFrame(b *testing.B) {
+	benchmarkAEADWriteFrame(b, NewAESGCMCryptoIO("test_test_test"))
+}
+
+func BenchmarkAESGCMReadPacket(b *testing.B) {
+	benchmarkAEADReadPacket(b, NewAESGCMCryptoIO("test_test_test"))
+}
+
+func BenchmarkChaCha20Poly1305WriteFrame(b *testing.B) {
+	benchmarkAEADWriteFrame(b, NewChaCha20Poly1305CryptoIO("test_test_test"))
+}
+
+func BenchmarkChaCha20Poly1305ReadPacket(b *testing.B) {
+	benchmarkAEADReadPacket(b, NewChaCha20Poly1305CryptoIO("test_test_test"))
+}
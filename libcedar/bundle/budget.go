@@ -0,0 +1,69 @@
+package bundle
+
+import (
+	"sync/atomic"
+)
+
+/*
+memoryBudget limits bytes held by bundles of an endpoint, for packets received but not forwarded yet.
+Only packets out of order are refused by it, those taken by force are counted but never refused.
+*/
+type memoryBudget struct {
+	limit int64 //no limit if <= 0
+	used  int64
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	ret := new(memoryBudget)
+	ret.limit = limit
+	ret.used = 0
+	return ret
+}
+
+/*
+take reserves n bytes. It fails if the budget is used up, unless force is set.
+*/
+func (b *memoryBudget) take(n int64, force bool) bool {
+	for {
+		used := atomic.LoadInt64(&b.used)
+		limit := atomic.LoadInt64(&b.limit)
+		if !force && limit > 0 && used+n > limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+/*
+release frees n bytes taken.
+*/
+func (b *memoryBudget) release(n int64) {
+	atomic.AddInt64(&b.used, -n)
+}
+
+/*
+inUse returns bytes taken.
+*/
+func (b *memoryBudget) inUse() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+/*
+setLimit changes the limit, 0 means no limit.
+*/
+func (b *memoryBudget) setLimit(limit int64) {
+	atomic.StoreInt64(&b.limit, limit)
+}
+
+/*
+setMemoryBudget makes the bundle share budget b, with other bundles of the endpoint.
+*/
+func (bd *FiberBundle) setMemoryBudget(b *memoryBudget) {
+	bd.receiveLock.Lock()
+	b.take(bd.buffered, true)
+	bd.budget.release(bd.buffered)
+	bd.budget = b
+	bd.receiveLock.Unlock()
+}
@@ -0,0 +1,77 @@
+package bundle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100)
+	if !b.take(60, false) || b.take(60, false) {
+		panic("budget should be limited")
+	}
+	if !b.take(60, true) || b.inUse() != 120 {
+		panic("forced one should be taken anyway")
+	}
+	b.release(120)
+	b.setLimit(0)
+	if !b.take(1000, false) {
+		panic("budget should not be limited")
+	}
+}
+
+func TestBundleMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(50)
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000}
+	bd := NewFiberBundle(50, "server", &hsr)
+	bd.setMemoryBudget(budget)
+	received := make(chan []byte, 10)
+	bd.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+
+	first := uint32(4000000)
+	msg := make([]byte, 20)
+	send := func(i uint32, stream uint32, after uint32) {
+		bd.PacketReceived(&FiberPacket{first + i, typeSendData, streamMessage(stream, after, 0, msg)})
+	}
+
+	//1 waits for 0, 2 waits for 1, and the budget only fits one of them
+	send(1, 1, 1)
+	send(2, 1, 1)
+	bd.receiveLock.RLock()
+	_, ok := bd.receiveBuffer[first+2]
+	bd.receiveLock.RUnlock()
+	if ok || budget.inUse() != int64(len(msg)+streamHeaderLen) {
+		panic("packet over budget should be dropped")
+	}
+
+	//0 is taken anyway, since it could be forwarded at once
+	send(0, 1, 0)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			panic("no message got and test failed")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if budget.inUse() != 0 {
+		panic("memory should be released after forwarding")
+	}
+
+	//resent later
+	send(2, 1, 1)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		panic("no message got and test failed")
+	}
+
+	send(4, 1, 1)
+	bd.Close(nil)
+	if budget.inUse() != 0 {
+		panic("memory should be released after closing")
+	}
+	time.Sleep(100 * time.Millisecond)
+}
@@ -0,0 +1,63 @@
+package bundle
+
+import (
+	"sync"
+)
+
+/*
+Buffers are pooled by size class, powers of 2 from 1<<minPooledShift to 1<<maxPooledShift bytes.
+Larger ones are allocated and dropped as usual.
+*/
+const (
+	minPooledShift = 9
+	maxPooledShift = 20
+)
+
+var bufferPools [maxPooledShift - minPooledShift + 1]sync.Pool
+
+/*
+pooledBuffer is a buffer taken from the pools. It should be released after use.
+*/
+type pooledBuffer struct {
+	bytes []byte
+}
+
+/*
+sizeClass returns the class for buffers of size, or -1 if it is too large.
+*/
+func sizeClass(size int) int {
+	for c := range bufferPools {
+		if size <= 1<<uint(c+minPooledShift) {
+			return c
+		}
+	}
+	return -1
+}
+
+/*
+getBuffer returns a buffer of len size, reused if possible.
+Contents of it are not cleared.
+*/
+func getBuffer(size int) *pooledBuffer {
+	c := sizeClass(size)
+	if c < 0 {
+		return &pooledBuffer{make([]byte, size)}
+	}
+	if v := bufferPools[c].Get(); v != nil {
+		buf := v.(*pooledBuffer)
+		buf.bytes = buf.bytes[:size]
+		return buf
+	}
+	return &pooledBuffer{make([]byte, size, 1<<uint(c+minPooledShift))}
+}
+
+/*
+release puts the buffer back to the pools. It should not be used afterwards.
+*/
+func (buf *pooledBuffer) release() {
+	c := sizeClass(cap(buf.bytes))
+	if c < 0 || cap(buf.bytes) != 1<<uint(c+minPooledShift) {
+		return
+	}
+	bufferPools[c].Put(buf)
+}
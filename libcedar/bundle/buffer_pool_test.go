@@ -0,0 +1,23 @@
+package bundle
+
+import (
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	if sizeClass(1) != 0 || sizeClass(512) != 0 || sizeClass(513) != 1 || sizeClass(1<<maxPooledShift+1) != -1 {
+		panic("size class error")
+	}
+
+	buf := getBuffer(1000)
+	if len(buf.bytes) != 1000 || cap(buf.bytes) != 1024 {
+		panic("buffer size error")
+	}
+	buf.release()
+
+	large := getBuffer(1<<maxPooledShift + 1)
+	if len(large.bytes) != 1<<maxPooledShift+1 {
+		panic("buffer size error")
+	}
+	large.release()
+}
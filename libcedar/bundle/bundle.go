@@ -1,7 +1,6 @@
 package bundle
 
 import (
-	"encoding/binary"
 	"errors"
 	"strings"
 	"sync"
@@ -28,29 +27,69 @@ const (
 )
 
 type FiberBundle struct {
-	id   uint32
-	seqs [2]uint32
-	next uint32
+	id         uint32
+	bundleType uint32 //serverBundle or clientBundle
+	seqs       [2]uint32
+
+	user       string   //ID of user of multi-user server, "" if not
+	sessionKey []byte   //agreed in handshake
+	encryptor  CryptoIO //of fibers, with keys from sessionKey
+	rekey      rekeyState
 
 	fibersLock sync.RWMutex
 	fibers     []*Fiber
+	fiberReady chan empty //closed (then replaced) when a fiber is added or its congestion window opens, to wake up waiters
+	scheduler  FiberScheduler
+	shaping    FiberShaping  //for fibers added afterwards
+	coalesce   time.Duration //for fibers added afterwards
 
 	bufferLen      uint32
 	receiveLock    sync.RWMutex
 	receiveBuffer  map[uint32]*FiberPacket
 	receiveChannel chan empty
-
-	sendTokens chan empty //token bucket for sending
-	sendLock   sync.RWMutex
-	//sendBuffer map[uint32]*FiberPacket
+	fecDecoder     *fecDecoder
+	forwarded      map[uint32]empty            //IDs forwarded ahead of seqs[download]
+	fragments      map[fragmentKey]*reassembly //messages not complete yet
+	waiting        map[uint32]uint32           //packet waiting for the previous one of its stream, by ID of the previous one
+	ready          []uint32                    //IDs of packets could be forwarded, in order
+	budget         *memoryBudget               //shared by bundles of an endpoint
+	buffered       int64                       //bytes in receiveBuffer
+
+	sendTokens  chan empty //token bucket for sending
+	bulkTokens  chan empty //bulk messages take these as well, so they cannot take all sendTokens
+	sendLock    sync.RWMutex
+	sendQueues  [numPriorities]chan *pendingPacket
+	inFlight    map[uint32]*pendingPacket //packets sent but not confirmed, by id
+	sendBase    uint32                    //packets before it are all confirmed
+	lostFibers  chan *Fiber
+	streamLast  map[uint32]uint32         //ID of last packet sent, by stream
+	streamSweep int                       //streamLast is cleaned when it grows over this
+	queueLocks  [numPriorities]sync.Mutex //fragments of a message are queued together
+	mtu         int                       //max size of message in one packet
+	maxFrame    int                       //of this side, no limit if 0
+	peerFrame   int                       //of the other side, from handshake, no limit if 0
+	maxMessage  int                       //max size of message sent or received
+
+	peerEdge     uint32     //IDs before it fit in the window advertised by the other side
+	windowOpened chan empty //signaled when peerEdge moves
+
+	//before the other side advertises a window, globalInitialWindow is assumed from assumedBase
+	windowKnown bool
+	assumedBase uint32
+	overWindow  []*pendingPacket    //sent beyond the window first advertised, so dropped by the other side
+	resendNow   chan *pendingPacket //packets of overWindow with room in the window
+
+	copies    [numPriorities]int //number of fibers each data packet is written to, by default
+	fecData   int                //number of data packets in a FEC group, 0 if FEC is disabled
+	fecParity int                //number of parity packets in a FEC group
+	sizer     *windowSizer       //nil if window is fixed to bufferLen
+	reserved  uint32             //tokens held to make the window smaller than bufferLen
 
 	closeChan chan error
 	cleaned   uint32
 
-	confirmGotSignal map[uint32]chan empty
-	confirmGotLock   sync.RWMutex
-
 	received *bundleReceivedIDs
+	rtt      *rttEstimator
 
 	//onBundleCreated FuncBundleCreated
 	callbackLock sync.RWMutex
@@ -63,9 +102,11 @@ func NewFiberBundle(bufferLen uint32, bundleType string, hsr *HandshakeResult) *
 	ret := new(FiberBundle)
 
 	if strings.ToLower(bundleType) == "server" {
+		ret.bundleType = serverBundle
 		ret.seqs[upload] = hsr.idS2C
 		ret.seqs[download] = hsr.idC2S
 	} else if strings.ToLower(bundleType) == "client" {
+		ret.bundleType = clientBundle
 		ret.seqs[upload] = hsr.idC2S
 		ret.seqs[download] = hsr.idS2C
 	} else {
@@ -73,29 +114,70 @@ func NewFiberBundle(bufferLen uint32, bundleType string, hsr *HandshakeResult) *
 	}
 
 	ret.id = hsr.id
-	ret.next = 0
+	ret.user = hsr.user
+	ret.sessionKey = hsr.key
+	ret.peerFrame = int(hsr.maxFrame)
+	ret.SetRekeying(globalRekeyBytes, globalRekeyInterval)
 
 	if bufferLen == 0 {
 		bufferLen = 1
 	}
 	ret.fibers = make([]*Fiber, 0)
+	ret.fiberReady = make(chan empty)
+	ret.scheduler = NewRoundRobinScheduler()
 
 	ret.bufferLen = bufferLen
 	ret.receiveBuffer = make(map[uint32]*FiberPacket)
 	ret.receiveChannel = make(chan empty, bufferLen)
-	ret.confirmGotSignal = make(map[uint32]chan empty)
+	ret.fecDecoder = newFecDecoder()
+	ret.forwarded = make(map[uint32]empty)
+	ret.fragments = make(map[fragmentKey]*reassembly)
+	ret.maxMessage = globalMaxMessage
+	ret.waiting = make(map[uint32]uint32)
+	ret.budget = newMemoryBudget(0)
 
 	ret.sendTokens = make(chan empty, bufferLen)
-	//ret.sendBuffer = make(map[uint32]*FiberPacket)
+	ret.bulkTokens = make(chan empty, bufferLen-bufferLen/4)
+	for i := range ret.sendQueues {
+		ret.sendQueues[i] = make(chan *pendingPacket, bufferLen)
+	}
+	ret.inFlight = make(map[uint32]*pendingPacket)
+	ret.sendBase = ret.seqs[upload]
+	ret.lostFibers = make(chan *Fiber, 0xff)
+	ret.streamLast = make(map[uint32]uint32)
+	ret.streamSweep = 64
+	ret.mtu = globalMTU
+
+	initialWindow := globalInitialWindow
+	if bufferLen < initialWindow {
+		initialWindow = bufferLen
+	}
+	ret.peerEdge = ret.sendBase + initialWindow
+	ret.windowOpened = make(chan empty, 1)
+	ret.windowKnown = false
+	ret.assumedBase = ret.sendBase
+	ret.resendNow = make(chan *pendingPacket, initialWindow)
+	for i := range ret.copies {
+		ret.copies[i] = 1
+	}
+	ret.fecData, ret.fecParity = 0, 0
+	ret.sizer = nil
+	ret.reserved = 0
 
 	ret.closeChan = make(chan error, 0xff)
 
-	ret.received = newBundleReceivedIDs()
+	ackEvery := globalAckEvery
+	if int(bufferLen/2) < ackEvery {
+		ackEvery = int(bufferLen / 2)
+	}
+	ret.received = newBundleReceivedIDs(ackEvery, bufferLen)
+	ret.rtt = newRttEstimator()
 
 	ret.onReceived = nil
 	ret.onFiberLost = nil
 	ret.onBundleLost = nil
 
+	go ret.keepSending()
 	go ret.keepConfirming()
 	go ret.keepForwarding()
 
@@ -120,6 +202,66 @@ func (bd *FiberBundle) SetOnBundleLost(f FuncBundleLost) {
 	bd.callbackLock.Unlock()
 }
 
+/*
+SetAutoWindow makes the sending window adjusted automatically in [minLen, bufferLen],
+according to measured bandwidth and RTT. It should be called before sending anything.
+*/
+func (bd *FiberBundle) SetAutoWindow(minLen uint32) {
+	bd.sendLock.Lock()
+	defer bd.sendLock.Unlock()
+
+	bd.sizer = newWindowSizer(minLen, bd.bufferLen, time.Now())
+	bd.resizeWindow()
+}
+
+/*
+SetDuplication makes each data packet written to k distinct fibers (if there are), by default.
+The other side drops duplicated ones. k = 1 disables duplication.
+*/
+func (bd *FiberBundle) SetDuplication(k int) {
+	for prio := range bd.copies {
+		bd.SetPriorityDuplication(Priority(prio), k)
+	}
+}
+
+/*
+SetPriorityDuplication is like SetDuplication, but only for messages of priority prio.
+*/
+func (bd *FiberBundle) SetPriorityDuplication(prio Priority, k int) {
+	if k < 1 {
+		k = 1
+	}
+	bd.sendLock.Lock()
+	bd.copies[validPriority(prio)] = k
+	bd.sendLock.Unlock()
+}
+
+/*
+Window returns current number of messages allowed to be sent but not confirmed.
+*/
+func (bd *FiberBundle) Window() uint32 {
+	bd.sendLock.RLock()
+	defer bd.sendLock.RUnlock()
+	return bd.bufferLen - bd.reserved
+}
+
+/*
+User returns ID of the user of this bundle, found in handshake by a multi-user server. It is "" if not.
+*/
+func (bd *FiberBundle) User() string {
+	return bd.user
+}
+
+/*
+SetScheduler sets the strategy choosing fibers to write on.
+By default, RoundRobinScheduler is used.
+*/
+func (bd *FiberBundle) SetScheduler(s FiberScheduler) {
+	bd.fibersLock.Lock()
+	bd.scheduler = s
+	bd.fibersLock.Unlock()
+}
+
 func (bd *FiberBundle) GetSize() int {
 	bd.fibersLock.RLock()
 	x := len(bd.fibers)
@@ -127,110 +269,271 @@ func (bd *FiberBundle) GetSize() int {
 	return x
 }
 
+/*
+SetShaping limits the rate of each fiber added afterwards.
+*/
+func (bd *FiberBundle) SetShaping(s FiberShaping) {
+	bd.fibersLock.Lock()
+	bd.shaping = s
+	bd.fibersLock.Unlock()
+}
+
+/*
+newShaper creates the rate limiter for a new fiber, or nil if the rate is not limited.
+*/
+func (bd *FiberBundle) newShaper() *tokenBucket {
+	bd.fibersLock.RLock()
+	defer bd.fibersLock.RUnlock()
+
+	if bd.shaping.Rate <= 0 {
+		return nil
+	}
+	return newTokenBucket(bd.shaping, time.Now())
+}
+
 /*
 GetFiberToWrite gets a Fiber to write on, for sending message.
-By design, this function is not thread safe.
+The fiber is chosen by scheduler of the bundle.
+It blocks until there is one fiber, and returns nil if bundle is closed.
 */
 func (bd *FiberBundle) GetFiberToWrite() *Fiber {
 	for {
-		bd.fibersLock.Lock()
-		x := len(bd.fibers)
-		//LogDebug("bundle id:", bd.id, "size:", x)
-		if x == 0 {
-			bd.fibersLock.Unlock()
+		fb, fiberReady := bd.chooseFiber(false)
+		if fb != nil {
+			return fb
+		}
 
-			select {
-			case err := <-bd.closeChan:
-				bd.closeChan <- err
-				LogDebug("[Bundle.GetFiberToWrite] closeChan got")
-				return nil
-			case <-time.After(time.Second * 1): //1s, wait until there is one connection
-				continue
-			}
-		} else {
-			break
+		//wait until there is one connection
+		select {
+		case err := <-bd.closeChan:
+			bd.closeChan <- err
+			LogDebug("[Bundle.GetFiberToWrite] closeChan got")
+			return nil
+		case <-fiberReady:
+			continue
 		}
 	}
+}
 
-	defer bd.fibersLock.Unlock()
-	bd.next = (bd.next + 1) % uint32(len(bd.fibers))
+/*
+getFiberToSend gets a Fiber to send data packets on, fibers with full congestion window are skipped.
+If all fibers are congested for an RTO, one is returned anyway, as acknowledgements might be lost.
+It returns nil if bundle is closed.
+*/
+func (bd *FiberBundle) getFiberToSend() *Fiber {
+	var deadline <-chan time.Time
+	for {
+		fb, fiberReady := bd.chooseFiber(true)
+		if fb != nil {
+			return fb
+		}
+		if deadline == nil {
+			deadline = time.After(bd.rtt.getRTO())
+		}
 
-	return bd.fibers[bd.next]
+		select {
+		case err := <-bd.closeChan:
+			bd.closeChan <- err
+			LogDebug("[Bundle.getFiberToSend] closeChan got")
+			return nil
+		case <-fiberReady:
+			continue
+		case <-deadline:
+			LogDebug("[Bundle.getFiberToSend] all fibers congested")
+			return bd.GetFiberToWrite()
+		}
+	}
 }
 
-func (bd *FiberBundle) SendMessage(msg []byte) error {
-	bd.sendTokens <- empty{}
-	pkt := FiberPacket{
-		atomic.AddUint32(&(bd.seqs[upload]), 1) - 1,
-		typeSendData,
-		msg,
+/*
+chooseFiber asks the scheduler to choose among fibers living (and not congested, if skipCongested).
+For data packets (skipCongested), fibers under their rate limit are preferred, to spread the load.
+If there is no such fiber, it returns nil and a channel closed when fibers change.
+*/
+func (bd *FiberBundle) chooseFiber(skipCongested bool) (*Fiber, chan empty) {
+	bd.fibersLock.RLock()
+	defer bd.fibersLock.RUnlock()
+
+	//skip fibers closed but not removed yet
+	candidates := make([]*Fiber, 0, len(bd.fibers))
+	for _, v := range bd.fibers {
+		if !v.IsClosed() && !(skipCongested && v.congested()) {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, bd.fiberReady
 	}
 
-	LogDebug("[Bundle.SendMessage] ", pkt.id, ShortHash(msg))
-	go bd.keepSending(pkt)
+	if skipCongested {
+		unthrottled := make([]*Fiber, 0, len(candidates))
+		for _, v := range candidates {
+			if !v.throttled() {
+				unthrottled = append(unthrottled, v)
+			}
+		}
+		if len(unthrottled) > 0 {
+			candidates = unthrottled
+		}
+	}
+	return bd.scheduler.Choose(candidates), nil
+}
 
-	return nil
+/*
+chooseOthers chooses up to n distinct fibers other than exclude, congested ones are skipped.
+*/
+func (bd *FiberBundle) chooseOthers(exclude *Fiber, n int) []*Fiber {
+	bd.fibersLock.RLock()
+	defer bd.fibersLock.RUnlock()
+
+	candidates := make([]*Fiber, 0, len(bd.fibers))
+	for _, v := range bd.fibers {
+		if v != exclude && !v.IsClosed() && !v.congested() {
+			candidates = append(candidates, v)
+		}
+	}
+
+	ret := make([]*Fiber, 0, n)
+	for len(ret) < n && len(candidates) > 0 {
+		fb := bd.scheduler.Choose(candidates)
+		ret = append(ret, fb)
+		for i, v := range candidates {
+			if v == fb {
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				break
+			}
+		}
+	}
+	return ret
 }
 
 /*
-keepSending would be called once for every message (in goroutine).
-It ends until message is sent and confirmed.
+wakeFiberWaiters wakes up goroutines waiting for a fiber.
 */
-func (bd *FiberBundle) keepSending(pkt FiberPacket) {
-	bd.confirmGotLock.Lock()
-	bd.confirmGotSignal[pkt.id] = make(chan empty, 0xff)
-	thisChannel := bd.confirmGotSignal[pkt.id]
-	bd.confirmGotLock.Unlock()
+func (bd *FiberBundle) wakeFiberWaiters() {
+	bd.fibersLock.Lock()
+	close(bd.fiberReady)
+	bd.fiberReady = make(chan empty)
+	bd.fibersLock.Unlock()
+}
 
-	for {
-		//LogDebug("Geting Fiber", pkt.id, len(pkt.message), pkt.ms+gType)
-		fb := bd.GetFiberToWrite()
-		if fb == nil {
-			goto ended
+/*
+SendMessage sends msg reliably via the bundle, on stream 0.
+Messages of higher priority are sent first, those of the same priority are sent in order.
+It blocks when too many messages are not confirmed yet.
+Bulk messages cannot take all the window, some is kept for other classes.
+msg is not used after it returns.
+*/
+func (bd *FiberBundle) SendMessage(msg []byte, prio Priority) error {
+	return bd.sendMessage(0, msg, prio, 0)
+}
+
+/*
+SendStreamMessage sends msg like SendMessage, but on the given stream.
+The other side forwards messages of a stream in the order they are sent,
+but a message lost on one stream does not hold back others.
+*/
+func (bd *FiberBundle) SendStreamMessage(stream uint32, msg []byte, prio Priority) error {
+	return bd.sendMessage(stream, msg, prio, 0)
+}
+
+/*
+SendMessageCopies sends msg like SendMessage, but writes it to copies distinct fibers at once,
+trading bandwidth for latency on lossy links. copies <= 0 means the default of the bundle.
+*/
+func (bd *FiberBundle) SendMessageCopies(msg []byte, prio Priority, copies int) error {
+	return bd.sendMessage(0, msg, prio, copies)
+}
+
+/*
+sendMessage queues msg for keepSending, fragmented if it is larger than MTU.
+*/
+func (bd *FiberBundle) sendMessage(stream uint32, msg []byte, prio Priority, copies int) error {
+	prio = validPriority(prio)
+
+	bd.sendLock.RLock()
+	mtu, maxMessage := bd.fragmentSize(), bd.maxMessage
+	if copies <= 0 {
+		copies = bd.copies[prio]
+	}
+	bd.sendLock.RUnlock()
+
+	if len(msg) > maxMessage {
+		return ErrMessageTooLarge
+	}
+
+	//fragments of another message of the same priority must not be queued in between
+	bd.queueLocks[prio].Lock()
+	defer bd.queueLocks[prio].Unlock()
+
+	for start := 0; ; start += mtu {
+		end := start + mtu
+		if end > len(msg) {
+			end = len(msg)
 		}
 
-		LogDebug("[Bundle.keepSending.Got]", pkt.id)
-		fb.write(pkt)
-		LogDebug("[Bundle.keepSending.Wrote]", pkt.id)
-		//LogDebug("[Step  3] pkt.id, len(pkt.msg), pkt.msgType", pkt.id, len(pkt.message), pkt.msgType)
+		if prio == PriorityBulk {
+			bd.bulkTokens <- empty{}
+		}
+		bd.sendTokens <- empty{}
+
+		p := new(pendingPacket)
+		p.size = int64(end - start)
+		p.prio = prio
+		p.stream = stream
+		p.more = end < len(msg)
+		p.copies = copies
+		//msg is copied, so the caller could reuse it after return.
+		//ID and stream header are filled when it is sent, in keepSending
+		payload := make([]byte, streamHeaderLen+end-start)
+		copy(payload[streamHeaderLen:], msg[start:end])
+		p.pkt = FiberPacket{0, typeSendData, payload}
+
+		bd.sendQueues[prio] <- p
+
+		if !p.more {
+			return nil
+		}
+	}
+}
 
+/*
+keepConfirming sends acknowledgements which are not piggybacked on data packets.
+Acknowledgement is delayed until globalAckEvery packets received or globalConfirmWait passed.
+*/
+func (bd *FiberBundle) keepConfirming() {
+	for {
 		select {
-		case <-time.After(globalResend):
-			break
-		case <-thisChannel:
-			//LogDebug("[Step  8] keepSending is closing: id", pkt.id)
-			goto ended
+		case <-bd.received.dirtySignal:
 		case err := <-bd.closeChan:
 			bd.closeChan <- err
-			LogDebug("[Bundle.keepSending] closeChan got")
-			goto ended
+			LogDebug("[Bundle.keepConfirming] closeChan got")
+			return
 		}
-	}
 
-ended:
-	bd.confirmGotLock.Lock()
-	//LogDebug("pkt.id sent successfully", pkt.id)
-	delete(bd.confirmGotSignal, pkt.id)
-	close(thisChannel)
-	bd.confirmGotLock.Unlock()
+		select {
+		case <-bd.received.fullSignal:
+		case <-time.After(globalConfirmWait):
+		case err := <-bd.closeChan:
+			bd.closeChan <- err
+			LogDebug("[Bundle.keepConfirming] closeChan got")
+			return
+		}
 
-	<-bd.sendTokens
-}
+		info := bd.received.getMessage(atomic.LoadUint32(&bd.seqs[download]))
+		if info == nil {
+			//piggybacked already
+			continue
+		}
 
-func (bd *FiberBundle) keepConfirming() {
-	for {
 		fb := bd.GetFiberToWrite()
 		if fb == nil {
 			return
 		}
-
-		info := bd.received.getMessage()
-		if info != nil && len(info) > 0 {
-			fb.write(FiberPacket{0, typeDataReceived, info})
-			LogDebug(time.Now(), "=============", len(info))
+		if err := fb.write(FiberPacket{0, typeDataReceived, info}, PriorityControl); err != nil {
+			//send it again on another fiber
+			bd.received.markDirty()
 		}
-
-		time.Sleep(globalConfirmWait)
 	}
 }
 
@@ -238,10 +541,27 @@ func (bd *FiberBundle) keepConfirming() {
 PacketReceived is called to notify the bundle that a new data packet received.
 */
 func (bd *FiberBundle) PacketReceived(pkt *FiberPacket) {
+	if pkt.msgType == typeSendDataWithAck {
+		ack, msg, err := detachAck(pkt.message)
+		if err != nil {
+			LogDebug("[Bundle.keepReceiving.illegalPiggyback]", err)
+			return
+		}
+		bd.PacketReceived(&FiberPacket{0, typeDataReceived, ack})
+		pkt = &FiberPacket{pkt.id, typeSendData, msg}
+	}
+
 	if pkt.msgType == typeSendData {
 		seqStatus := bd.seqCheck(pkt.id)
+		_, after, _, _, err := parseStreamMessage(pkt.message)
+		if err != nil {
+			LogDebug("[Bundle.keepReceiving.illegalStream]", err)
+			return
+		}
 		if seqStatus == seqOutOfRange {
+			//the other side does not know our window, advertise it again
 			LogDebug("[Bundle.keepReceiving.outOfRange]", pkt.id)
+			bd.received.markDirty()
 			return
 		}
 		if seqStatus == seqReceived {
@@ -254,7 +574,25 @@ func (bd *FiberBundle) PacketReceived(pkt *FiberPacket) {
 		LogDebug("[Bundle.keepReceiving]", pkt.id)
 
 		bd.receiveLock.Lock()
+		//check again, a copy on another fiber might be received (or even forwarded) meanwhile
+		_, exists := bd.receiveBuffer[pkt.id]
+		if exists || bd.seqCheck(pkt.id) != seqInRange || bd.isForwarded(pkt.id) {
+			bd.receiveLock.Unlock()
+			LogDebug("[Bundle.keepReceiving.dupSeqReceived]", pkt.id)
+			bd.received.addID(pkt.id)
+			return
+		}
+		//packets could be forwarded at once are always taken, so the budget never stops a bundle.
+		//others are dropped if it is used up, and sent again later.
+		canForward := after == 0 || bd.isForwarded(pkt.id-after)
+		if bd.IsClosed() || !bd.budget.take(int64(len(pkt.message)), canForward) {
+			bd.receiveLock.Unlock()
+			LogDebug("[Bundle.keepReceiving.overBudget]", pkt.id)
+			return
+		}
+		bd.buffered += int64(len(pkt.message))
 		bd.receiveBuffer[pkt.id] = pkt
+		bd.streamPacketReceived(pkt.id, after)
 		bd.receiveLock.Unlock()
 
 		LogDebug("[Bundle.keepReceiving.receiveBufferAdded]", pkt.id)
@@ -264,25 +602,18 @@ func (bd *FiberBundle) PacketReceived(pkt *FiberPacket) {
 		LogDebug("[Bundle.keepReceiving.confirmBufferAdded]", pkt.id)
 	}
 
+	if pkt.msgType == typeFECParity {
+		bd.parityReceived(pkt)
+	}
+
 	if pkt.msgType == typeDataReceived {
-		buf := pkt.message
-
-		bd.confirmGotLock.Lock()
-		dupIds := make(map[uint32]bool)
-		for i := 0; i < len(buf); i += 4 {
-			id := binary.BigEndian.Uint32(buf[i : i+4])
-			_, found := dupIds[id]
-			if found {
-				continue
-			}
-			dupIds[id] = true
-			LogDebug("[Bundle.keepReceiving.confirmReceived]", id)
-			chn, ok := bd.confirmGotSignal[id]
-			if ok {
-				chn <- empty{}
-			}
+		cum, window, ranges, err := parseAckMessage(pkt.message)
+		if err != nil {
+			LogDebug("[Bundle.keepReceiving.illegalConfirm]", err)
+			return
 		}
-		bd.confirmGotLock.Unlock()
+
+		bd.confirmPackets(cum, window, ranges)
 	}
 }
 
@@ -301,6 +632,9 @@ func (bd *FiberBundle) FiberCreated(fb *Fiber) {
 		}
 	}
 	bd.fibers = append(bd.fibers, fb)
+
+	close(bd.fiberReady)
+	bd.fiberReady = make(chan empty)
 }
 
 /*
@@ -323,6 +657,8 @@ func (bd *FiberBundle) FiberClosed(fb *Fiber) {
 		return
 	}
 
+	bd.fiberLost(fb)
+
 	bd.callbackLock.RLock()
 	if bd.onFiberLost != nil {
 		go bd.onFiberLost(bd.id)
@@ -359,6 +695,15 @@ func (bd *FiberBundle) Close(err error) {
 	bd.fibers = bd.fibers[:0]
 	bd.fibersLock.Unlock() //NOTE: cannot defer, otherwise FiberClosed gets stuck
 
+	//packets not forwarded are dropped, and their memory goes back to the budget
+	bd.receiveLock.Lock()
+	bd.budget.release(bd.buffered)
+	bd.buffered = 0
+	bd.receiveBuffer = make(map[uint32]*FiberPacket)
+	bd.waiting = make(map[uint32]uint32)
+	bd.ready = nil
+	bd.receiveLock.Unlock()
+
 	for i := 0; i < 5; i++ {
 		bd.closeChan <- err
 	}
@@ -375,25 +720,34 @@ func (bd *FiberBundle) keepForwarding() {
 		select {
 		case <-bd.receiveChannel:
 			bd.receiveLock.Lock()
-			for {
-				seq := bd.seqs[download]
-				pkt, ok := bd.receiveBuffer[seq]
-				//LogDebug("seq, status", seq, ok)
-				if ok {
-					atomic.AddUint32(&bd.seqs[download], 1)
-					bd.callbackLock.RLock()
-					if bd.onReceived != nil {
-						bd.onReceived(bd.id, pkt.message)
-						LogDebug("[keepForwarding]", pkt.id)
-					}
-					bd.callbackLock.RUnlock()
-				} else {
-					//LogDebug("[Step  9--] waiting for ", seq)
-					break
+			for len(bd.ready) > 0 {
+				seq := bd.ready[0]
+				bd.ready = bd.ready[1:]
+				pkt := bd.receiveBuffer[seq]
+				delete(bd.receiveBuffer, seq)
+				bd.buffered -= int64(len(pkt.message))
+				bd.budget.release(int64(len(pkt.message)))
+				bd.fecDecoder.remember(pkt)
+				bd.markForwarded(seq)
+
+				stream, _, flags, body, _ := parseStreamMessage(pkt.message)
+				key := fragmentKey{stream, Priority((flags & flagPriorityMask) >> flagPriorityShift)}
+				body, ok := bd.reassemble(key, flags&flagMoreFragments != 0, body)
+				if !ok {
+					continue
 				}
+				bd.callbackLock.RLock()
+				if bd.onReceived != nil {
+					bd.onReceived(bd.id, body)
+					LogDebug("[keepForwarding]", pkt.id)
+				}
+				bd.callbackLock.RUnlock()
 			}
 			bd.receiveLock.Unlock()
 
+			//cumulative ID moved, tell the other side
+			bd.received.updateCum(atomic.LoadUint32(&bd.seqs[download]))
+
 		case err := <-bd.closeChan:
 			bd.closeChan <- err
 			LogDebug("[Bundle.keepForwarding] closeChan got")
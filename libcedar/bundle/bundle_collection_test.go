@@ -9,7 +9,7 @@ func TestBundleCollectionBasic(t *testing.T) {
 		panic("bundle collection should be empty")
 	}
 
-	bd := NewFiberBundle(50, "server", &HandshakeResult{5, 0, 0, nil})
+	bd := NewFiberBundle(50, "server", &HandshakeResult{id: 5})
 
 	err := bdc.AddBundle(bd)
 	if err != nil {
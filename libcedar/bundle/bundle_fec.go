@@ -0,0 +1,195 @@
+package bundle
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+fecEncoder collects data packets sent for the first time into groups.
+Only keepSending uses it.
+*/
+type fecEncoder struct {
+	first    uint32
+	messages [][]byte
+	started  time.Time
+}
+
+/*
+fecGroup keeps parity packets received for a group.
+*/
+type fecGroup struct {
+	k      int
+	parity [][]byte
+}
+
+/*
+fecDecoder keeps what is needed to reconstruct lost packets.
+receiveLock of the bundle protects it.
+*/
+type fecDecoder struct {
+	recent []FiberPacket //packets forwarded recently, by id % len
+	groups map[uint32]*fecGroup
+}
+
+func newFecDecoder() *fecDecoder {
+	ret := new(fecDecoder)
+	ret.recent = make([]FiberPacket, globalFECMaxShards*2)
+	ret.groups = make(map[uint32]*fecGroup)
+	return ret
+}
+
+/*
+remember keeps a packet forwarded, as it might be needed to reconstruct others in its group.
+*/
+func (dec *fecDecoder) remember(pkt *FiberPacket) {
+	dec.recent[pkt.id%uint32(len(dec.recent))] = *pkt
+}
+
+/*
+SetFEC makes m parity packets sent for each k data packets.
+Up to m packets lost in a group are reconstructed by the other side without retransmission.
+k = 0 disables it. m is at most globalFECMaxShards-1, and k is reduced to fit in a group.
+*/
+func (bd *FiberBundle) SetFEC(k int, m int) {
+	if k < 0 || m < 1 {
+		k = 0
+	}
+	if m > globalFECMaxShards-1 {
+		m = globalFECMaxShards - 1
+	}
+	if k+m > globalFECMaxShards {
+		k = globalFECMaxShards - m
+	}
+
+	bd.sendLock.Lock()
+	bd.fecData, bd.fecParity = k, m
+	bd.sendLock.Unlock()
+}
+
+/*
+fecAdd adds a data packet sent for the first time to current group.
+Parity packets are sent when the group is full.
+*/
+func (bd *FiberBundle) fecAdd(enc *fecEncoder, p *pendingPacket) {
+	bd.sendLock.RLock()
+	k := bd.fecData
+	bd.sendLock.RUnlock()
+	if k == 0 {
+		return
+	}
+
+	//IDs in a group are consecutive
+	if len(enc.messages) > 0 && p.pkt.id != enc.first+uint32(len(enc.messages)) {
+		bd.fecFlush(enc)
+	}
+	if len(enc.messages) == 0 {
+		enc.first = p.pkt.id
+		enc.started = time.Now()
+	}
+	enc.messages = append(enc.messages, p.pkt.message)
+	if len(enc.messages) >= k {
+		bd.fecFlush(enc)
+	}
+}
+
+/*
+fecFlush sends parity packets of current group, even if it is not full.
+Parity packets are striped across fibers by the scheduler. They are not resent if lost.
+*/
+func (bd *FiberBundle) fecFlush(enc *fecEncoder) {
+	if len(enc.messages) == 0 {
+		return
+	}
+	bd.sendLock.RLock()
+	m := bd.fecParity
+	bd.sendLock.RUnlock()
+
+	k := len(enc.messages)
+	for i, shard := range fecEncode(fecShards(enc.messages), m) {
+		fb, _ := bd.chooseFiber(false)
+		if fb == nil {
+			break
+		}
+		if err := fb.write(FiberPacket{enc.first, typeFECParity, parityMessage(k, m, i, shard)}, PriorityInteractive); err != nil {
+			LogDebug("[Bundle.fecFlush.writeFailed]", enc.first, err)
+		}
+	}
+	LogDebug("[Bundle.fecFlush]", enc.first, k, m)
+
+	enc.messages = enc.messages[:0]
+}
+
+/*
+parityReceived handles a parity packet, and reconstructs lost packets if possible.
+*/
+func (bd *FiberBundle) parityReceived(pkt *FiberPacket) {
+	k, m, index, shard, err := parseParityMessage(pkt.message)
+	if err != nil {
+		LogDebug("[Bundle.keepReceiving.illegalParity]", err)
+		return
+	}
+	first := pkt.id
+	dec := bd.fecDecoder
+	recovered := make([]*FiberPacket, 0)
+
+	bd.receiveLock.Lock()
+	cum := atomic.LoadUint32(&bd.seqs[download])
+	for id, g := range dec.groups {
+		if !seqBefore(cum, id+uint32(g.k)) {
+			delete(dec.groups, id)
+		}
+	}
+	if !seqBefore(cum, first+uint32(k)) {
+		//all forwarded
+		bd.receiveLock.Unlock()
+		return
+	}
+
+	g, ok := dec.groups[first]
+	if !ok || g.k != k || len(g.parity) != m {
+		if len(dec.groups) >= globalFECMaxGroups {
+			bd.receiveLock.Unlock()
+			return
+		}
+		g = &fecGroup{k, make([][]byte, m)}
+		dec.groups[first] = g
+	}
+	for _, v := range g.parity {
+		if v != nil && len(v) != len(shard) {
+			bd.receiveLock.Unlock()
+			LogDebug("[Bundle.keepReceiving.illegalParity]", first)
+			return
+		}
+	}
+	g.parity[index] = shard
+
+	data := make([][]byte, k)
+	missing := make([]int, 0)
+	for j := range data {
+		id := first + uint32(j)
+		if p, ok := bd.receiveBuffer[id]; ok {
+			data[j] = fecShard(p.message, len(shard))
+		} else if r := dec.recent[id%uint32(len(dec.recent))]; r.message != nil && r.id == id {
+			data[j] = fecShard(r.message, len(shard))
+		} else if bd.seqCheck(id) == seqInRange {
+			missing = append(missing, j)
+		}
+		//otherwise it is forwarded long ago, and treated as lost as well
+	}
+
+	if len(missing) > 0 && fecReconstruct(data, g.parity) == nil {
+		for _, j := range missing {
+			if msg := fecMessage(data[j]); msg != nil {
+				recovered = append(recovered, &FiberPacket{first + uint32(j), typeSendData, msg})
+			}
+		}
+		delete(dec.groups, first)
+	}
+	bd.receiveLock.Unlock()
+
+	for _, p := range recovered {
+		LogDebug("[Bundle.keepReceiving.recovered]", p.id)
+		bd.PacketReceived(p)
+	}
+}
@@ -2,45 +2,259 @@ package bundle
 
 import (
 	"encoding/binary"
+	"sort"
 	"sync"
 )
 
+/*
+maxAckRanges limits size of one acknowledgement.
+*/
+const maxAckRanges = 1024
+
+/*
+ackRange is a range of packet IDs [start, end) received out of order.
+*/
+type ackRange struct {
+	start uint32
+	end   uint32
+}
+
+/*
+bundleReceivedIDs keeps track of what should be acknowledged to the other side.
+Acknowledgement is selective: all IDs before the cumulative ID (next ID to forward)
+are confirmed at once, IDs received out of order are described by ranges.
+*/
 type bundleReceivedIDs struct {
-	confirmBuffer []uint32 //store ids to confirm
+	confirmBuffer []uint32 //store ids received ahead of cumulative id
+	dirty         bool     //true if something should be (re-)acknowledged
+	unacked       int      //number of packets received since last acknowledgement
+	ackEvery      int
+	lastCum       uint32 //cumulative id in last acknowledgement
+	resumeAt      uint32 //ranges from it are sent in next acknowledgement, when they are too many for one
+	window        uint32 //advertised window, IDs in [cum, cum+window) are accepted
 	confirmLock   sync.RWMutex
+
+	dirtySignal chan empty //signaled when dirty becomes true
+	fullSignal  chan empty //signaled when unacked reaches ackEvery
 }
 
-func newBundleReceivedIDs() *bundleReceivedIDs {
+/*
+newBundleReceivedIDs creates a bundleReceivedIDs.
+Acknowledgement is sent once ackEvery packets received, or after a delay.
+window is advertised to the other side with each acknowledgement.
+*/
+func newBundleReceivedIDs(ackEvery int, window uint32) *bundleReceivedIDs {
 	ret := new(bundleReceivedIDs)
 	ret.confirmBuffer = make([]uint32, 0, 128)
+	ret.dirty = false
+	ret.unacked = 0
+	if ackEvery < 1 {
+		ackEvery = 1
+	}
+	ret.ackEvery = ackEvery
+	ret.window = window
+	ret.dirtySignal = make(chan empty, 1)
+	ret.fullSignal = make(chan empty, 1)
 	return ret
 }
 
+func notify(c chan empty) {
+	select {
+	case c <- empty{}:
+	default:
+		//already signaled
+	}
+}
+
+/*
+setDirty marks that acknowledgement is needed. confirmLock should be held.
+*/
+func (lst *bundleReceivedIDs) setDirty() {
+	if !lst.dirty {
+		lst.dirty = true
+		notify(lst.dirtySignal)
+	}
+}
+
+/*
+addID marks id as received. It is also called for duplicated packets,
+so that the acknowledgement is sent again (the previous one might be lost).
+*/
 func (lst *bundleReceivedIDs) addID(id uint32) {
 	lst.confirmLock.Lock()
+	defer lst.confirmLock.Unlock()
+
+	lst.setDirty()
+	lst.unacked++
+	if lst.unacked >= lst.ackEvery {
+		notify(lst.fullSignal)
+	}
+
 	for _, v := range lst.confirmBuffer {
 		if v == id {
 			return
 		}
 	}
 	lst.confirmBuffer = append(lst.confirmBuffer, id)
+}
+
+/*
+markDirty asks for acknowledgement again, e.g. when the last one failed to be written.
+*/
+func (lst *bundleReceivedIDs) markDirty() {
+	lst.confirmLock.Lock()
+	lst.setDirty()
+	lst.confirmLock.Unlock()
+}
+
+/*
+updateCum asks for acknowledgement if cumulative id moved since last one.
+*/
+func (lst *bundleReceivedIDs) updateCum(cum uint32) {
+	lst.confirmLock.Lock()
+	if cum != lst.lastCum {
+		lst.setDirty()
+	}
 	lst.confirmLock.Unlock()
-	return
 }
 
 /*
-generateConfirmInfo returns nil when no IDs in list
+getMessage returns nil when nothing to acknowledge.
+Otherwise it returns the acknowledgement, with cumulative ID cum.
+
+Format:
+
+	[cumulative id 4B][window 4B]([range start 4B][range end 4B])*
 */
-func (lst *bundleReceivedIDs) getMessage() []byte {
+func (lst *bundleReceivedIDs) getMessage(cum uint32) []byte {
 	lst.confirmLock.Lock()
 	defer lst.confirmLock.Unlock()
 
-	ret := make([]byte, len(lst.confirmBuffer)*4)
-	for i := 0; i < len(ret); i += 4 {
-		binary.BigEndian.PutUint32(ret[i:i+4], lst.confirmBuffer[i/4])
-		LogDebug("[keepConfirming.confirmSent]", lst.confirmBuffer[i/4])
+	if !lst.dirty {
+		return nil
+	}
+	lst.dirty = false
+	lst.unacked = 0
+	lst.lastCum = cum
+	select {
+	case <-lst.fullSignal:
+	default:
+	}
+
+	//drop ids already covered by cum, keep others as offsets to cum
+	offsets := make([]uint32, 0, len(lst.confirmBuffer))
+	kept := lst.confirmBuffer[:0]
+	for _, v := range lst.confirmBuffer {
+		if seqBefore(v, cum) {
+			continue
+		}
+		kept = append(kept, v)
+		offsets = append(offsets, v-cum)
+	}
+	lst.confirmBuffer = kept
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	ranges := make([]ackRange, 0)
+	for _, v := range offsets {
+		n := len(ranges)
+		if n > 0 && ranges[n-1].end == cum+v {
+			ranges[n-1].end++
+			continue
+		}
+		ranges = append(ranges, ackRange{cum + v, cum + v + 1})
+	}
+	if len(ranges) > maxAckRanges {
+		//ranges are sent part by part, the next part is acknowledged at once
+		first := sort.Search(len(ranges), func(i int) bool { return ranges[i].start-cum >= lst.resumeAt-cum })
+		if first == len(ranges) {
+			first = 0
+		}
+		end := first + maxAckRanges
+		if end < len(ranges) {
+			lst.resumeAt = ranges[end-1].end
+			lst.setDirty()
+		} else {
+			end = len(ranges)
+			lst.resumeAt = cum
+		}
+		ranges = ranges[first:end]
+	} else {
+		lst.resumeAt = cum
 	}
-	lst.confirmBuffer = lst.confirmBuffer[:0]
+
+	ret := make([]byte, 8+len(ranges)*8)
+	binary.BigEndian.PutUint32(ret[0:4], cum)
+	binary.BigEndian.PutUint32(ret[4:8], lst.window)
+	for i, r := range ranges {
+		binary.BigEndian.PutUint32(ret[8+i*8:12+i*8], r.start)
+		binary.BigEndian.PutUint32(ret[12+i*8:16+i*8], r.end)
+	}
+	LogDebug("[keepConfirming.confirmSent]", cum, ranges)
 
 	return ret
 }
+
+/*
+parseAckMessage parses message generated by getMessage.
+It returns cumulative ID, window and ranges, or ErrIllegalPacket if message is malformed.
+*/
+func parseAckMessage(msg []byte) (uint32, uint32, []ackRange, error) {
+	if len(msg) < 8 || (len(msg)-8)%8 != 0 {
+		return 0, 0, nil, ErrIllegalPacket
+	}
+
+	cum := binary.BigEndian.Uint32(msg[0:4])
+	window := binary.BigEndian.Uint32(msg[4:8])
+	ranges := make([]ackRange, (len(msg)-8)/8)
+	for i := range ranges {
+		ranges[i].start = binary.BigEndian.Uint32(msg[8+i*8 : 12+i*8])
+		ranges[i].end = binary.BigEndian.Uint32(msg[12+i*8 : 16+i*8])
+	}
+
+	return cum, window, ranges, nil
+}
+
+/*
+attachAck puts acknowledgement ack before msg, for piggybacking on data packets.
+
+Format:
+
+	[length of ack 2B][ack][msg]
+*/
+func attachAck(ack []byte, msg []byte) []byte {
+	ret := make([]byte, 2+len(ack)+len(msg))
+	binary.BigEndian.PutUint16(ret[0:2], uint16(len(ack)))
+	copy(ret[2:], ack)
+	copy(ret[2+len(ack):], msg)
+	return ret
+}
+
+/*
+detachAck splits message generated by attachAck.
+It returns ErrIllegalPacket if message is malformed.
+*/
+func detachAck(msg []byte) ([]byte, []byte, error) {
+	if len(msg) < 2 {
+		return nil, nil, ErrIllegalPacket
+	}
+	n := int(binary.BigEndian.Uint16(msg[0:2]))
+	if len(msg) < 2+n {
+		return nil, nil, ErrIllegalPacket
+	}
+	return msg[2 : 2+n], msg[2+n:], nil
+}
+
+/*
+acked tells whether id is confirmed by cumulative id cum and ranges.
+*/
+func acked(id uint32, cum uint32, ranges []ackRange) bool {
+	if seqBefore(id, cum) {
+		return true
+	}
+	for _, r := range ranges {
+		if r.start != r.end && inRange(id, r.start, r.end) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package bundle
+
+import (
+	"testing"
+)
+
+func TestSelectiveAck(t *testing.T) {
+	lst := newBundleReceivedIDs(4, 30)
+
+	if lst.getMessage(100) != nil {
+		panic("nothing should be acknowledged")
+	}
+
+	//cum is near overflow, ranges cross it
+	cum := uint32(0xfffffffe)
+	for _, id := range []uint32{0xfffffff0, 0xffffffff, 0, 1, 5, 6, 1} {
+		lst.addID(id)
+	}
+
+	msg := lst.getMessage(cum)
+	if len(msg) != 8+2*8 {
+		panic("two ranges expected")
+	}
+	c, window, ranges, err := parseAckMessage(msg)
+	if err != nil || c != cum {
+		panic("cumulative id error")
+	}
+	if window != 30 {
+		panic("window error")
+	}
+	if ranges[0] != (ackRange{0xffffffff, 2}) || ranges[1] != (ackRange{5, 7}) {
+		panic("ranges error")
+	}
+
+	for _, id := range []uint32{0xfffffff0, 0xfffffffd, 0xffffffff, 0, 1, 5, 6} {
+		if !acked(id, c, ranges) {
+			panic("id should be acknowledged")
+		}
+	}
+	for _, id := range []uint32{0xfffffffe, 2, 4, 7, 100} {
+		if acked(id, c, ranges) {
+			panic("id should not be acknowledged")
+		}
+	}
+
+	if lst.getMessage(cum) != nil {
+		panic("acknowledgement should be sent only once")
+	}
+
+	//duplicated packet triggers acknowledgement again
+	lst.addID(6)
+	msg = lst.getMessage(7)
+	if len(msg) != 8 {
+		panic("only cumulative id expected")
+	}
+
+	if _, _, _, err := parseAckMessage([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}); err == nil {
+		panic("illegal message should be rejected")
+	}
+}
+
+func TestAckRangesTruncated(t *testing.T) {
+	lst := newBundleReceivedIDs(1, 30)
+
+	//every other id is received, each one is a range
+	count := maxAckRanges*2 + 10
+	for i := 0; i < count; i++ {
+		lst.addID(uint32(2*i + 1))
+	}
+
+	acknowledged := 0
+	for n := 0; n < 3; n++ {
+		msg := lst.getMessage(0)
+		if msg == nil {
+			panic("ranges left should be acknowledged at once")
+		}
+		_, _, ranges, err := parseAckMessage(msg)
+		if err != nil || len(ranges) > maxAckRanges {
+			panic("too many ranges")
+		}
+		if len(ranges) == 0 || ranges[0].start != uint32(2*acknowledged+1) {
+			panic("ranges should continue from the last acknowledgement")
+		}
+		acknowledged += len(ranges)
+	}
+	if acknowledged != count {
+		panic("all ranges should be acknowledged")
+	}
+	if lst.getMessage(0) != nil {
+		panic("nothing left to acknowledge")
+	}
+}
+
+func TestDelayedAck(t *testing.T) {
+	lst := newBundleReceivedIDs(3, 30)
+
+	lst.addID(0)
+	select {
+	case <-lst.dirtySignal:
+	default:
+		panic("dirtySignal should be sent on first packet")
+	}
+	lst.addID(1)
+	select {
+	case <-lst.fullSignal:
+		panic("fullSignal should wait for ackEvery packets")
+	default:
+	}
+	lst.addID(2)
+	select {
+	case <-lst.fullSignal:
+	default:
+		panic("fullSignal should be sent after ackEvery packets")
+	}
+
+	if lst.getMessage(3) == nil {
+		panic("acknowledgement expected")
+	}
+	lst.updateCum(3)
+	if lst.getMessage(3) != nil {
+		panic("cumulative id not moved")
+	}
+	lst.updateCum(4)
+	if lst.getMessage(4) == nil {
+		panic("cumulative id moved")
+	}
+
+	ack := []byte{1, 2, 3, 4}
+	ack2, data, err := detachAck(attachAck(ack, []byte("data")))
+	if err != nil || string(ack2) != string(ack) || string(data) != "data" {
+		panic("piggybacked message error")
+	}
+	if _, _, err := detachAck([]byte{0, 5, 1}); err == nil {
+		panic("illegal message should be rejected")
+	}
+}
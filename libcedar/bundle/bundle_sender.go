@@ -0,0 +1,444 @@
+package bundle
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+pendingPacket is the sending state of a packet not confirmed yet.
+Fields are protected by sendLock of the bundle.
+*/
+type pendingPacket struct {
+	pkt      FiberPacket
+	fiber    *Fiber //fiber it was last written on
+	size     int64
+	prio     Priority
+	stream   uint32
+	more     bool //more fragments of the message follow
+	copies   int  //number of fibers to write on
+	done     bool //confirmed, or bundle closed
+	attempts uint
+	timeouts uint
+	sentAt   time.Time
+	deadline time.Time
+}
+
+/*
+resendTimeout returns the retransmission timeout for packets written on fb.
+RTO of fb is used if it is measured, otherwise RTO of the whole bundle.
+*/
+func (bd *FiberBundle) resendTimeout(fb *Fiber) time.Duration {
+	if fb.rtt.hasSample() {
+		return fb.rtt.getRTO()
+	}
+	return bd.rtt.getRTO()
+}
+
+/*
+keepSending is the only goroutine sending data packets of the bundle.
+New packets come from SendMessage, old ones are resent when their timer in the wheel fires,
+or when the fiber they were written on is lost.
+New packets are taken by priority, and get their IDs here, so IDs follow the sending order.
+New packets beyond the window advertised by the other side wait until the window opens.
+Ones sent beyond it before it is advertised are resent once it has room for them.
+*/
+func (bd *FiberBundle) keepSending() {
+	wheel := newTimerWheel(globalWheelTick, globalWheelSize, time.Now())
+	var tick <-chan time.Time
+	var blocked *pendingPacket //new packet waiting for window
+	var probe <-chan time.Time
+	enc := new(fecEncoder)
+	var queued [numPriorities][]*pendingPacket //new packets taken from sendQueues
+	ready := make(chan empty)
+	close(ready)
+
+	//sendNew sends a packet for the first time
+	sendNew := func(p *pendingPacket) bool {
+		if !bd.transmit(p, wheel) {
+			return false
+		}
+		bd.fecAdd(enc, p)
+		return true
+	}
+
+	for {
+		if tick == nil && wheel.size() > 0 {
+			tick = time.After(globalWheelTick)
+		}
+		next := ready
+		prio, ok := nextPriority(&queued)
+		if blocked != nil || !ok {
+			next = nil
+		}
+
+		select {
+		case p := <-bd.sendQueues[PriorityControl]:
+			queued[p.prio] = append(queued[p.prio], p)
+
+		case p := <-bd.sendQueues[PriorityInteractive]:
+			queued[p.prio] = append(queued[p.prio], p)
+
+		case p := <-bd.sendQueues[PriorityBulk]:
+			queued[p.prio] = append(queued[p.prio], p)
+
+		case <-next:
+			p := bd.nextToSend(&queued, prio)
+			if !bd.inPeerWindow(p) {
+				LogDebug("[Bundle.keepSending.windowClosed]", p.pkt.id)
+				blocked = p
+				probe = time.After(bd.rtt.getRTO())
+				continue
+			}
+			if !sendNew(p) {
+				return
+			}
+
+		case <-bd.windowOpened:
+			if blocked != nil && bd.inPeerWindow(blocked) {
+				p := blocked
+				blocked, probe = nil, nil
+				if !sendNew(p) {
+					return
+				}
+			}
+
+		case <-probe:
+			//window update might be lost, send anyway so that the other side advertises again
+			LogDebug("[Bundle.keepSending.probe]", blocked.pkt.id)
+			p := blocked
+			blocked, probe = nil, nil
+			if !sendNew(p) {
+				return
+			}
+
+		case now := <-tick:
+			tick = nil
+			if len(enc.messages) > 0 && now.Sub(enc.started) >= globalFECFlush {
+				bd.fecFlush(enc)
+			}
+			for _, e := range wheel.advance(now) {
+				bd.sendLock.Lock()
+				due := !e.pending.done && e.pending.deadline.Equal(e.deadline)
+				if due {
+					e.pending.timeouts++
+					if fb := e.pending.fiber; fb != nil {
+						fb.cc.onTimeout(now, bd.resendTimeout(fb))
+					}
+				}
+				bd.sendLock.Unlock()
+
+				if due {
+					LogDebug("[Bundle.keepSending.timeout]", e.pending.pkt.id)
+					if !bd.transmit(e.pending, wheel) {
+						return
+					}
+				}
+			}
+
+		case p := <-bd.resendNow:
+			LogDebug("[Bundle.keepSending.overWindow]", p.pkt.id)
+			if !bd.transmit(p, wheel) {
+				return
+			}
+
+		case fb := <-bd.lostFibers:
+			bd.sendLock.RLock()
+			lost := make([]*pendingPacket, 0)
+			for _, p := range bd.inFlight {
+				if p.fiber == fb {
+					lost = append(lost, p)
+				}
+			}
+			bd.sendLock.RUnlock()
+
+			for _, p := range lost {
+				LogDebug("[Bundle.keepSending.fiberLost]", p.pkt.id)
+				if !bd.transmit(p, wheel) {
+					return
+				}
+			}
+
+		case err := <-bd.closeChan:
+			bd.closeChan <- err
+			LogDebug("[Bundle.keepSending] closeChan got")
+			return
+		}
+	}
+}
+
+/*
+transmit writes p on a fiber, and sets its retransmission timer.
+It returns false if the bundle is closed.
+*/
+func (bd *FiberBundle) transmit(p *pendingPacket, wheel *timerWheel) bool {
+	for {
+		fb := bd.getFiberToSend()
+		if fb == nil {
+			return false
+		}
+
+		bd.sendLock.Lock()
+		if p.done {
+			bd.sendLock.Unlock()
+			return true
+		}
+		bd.setPendingFiber(p, fb)
+		p.attempts++
+		p.sentAt = time.Now()
+
+		//exponential backoff for each timeout, bounded by globalResend
+		timeout := bd.resendTimeout(fb)
+		for i := uint(0); i < p.timeouts && timeout < globalResend; i++ {
+			timeout *= 2
+		}
+		p.deadline = p.sentAt.Add(boundRTO(timeout))
+		bd.sendLock.Unlock()
+
+		//piggyback acknowledgement if there is one
+		pkt := p.pkt
+		if ack := bd.received.getMessage(atomic.LoadUint32(&bd.seqs[download])); ack != nil {
+			pkt = FiberPacket{pkt.id, typeSendDataWithAck, attachAck(ack, pkt.message)}
+		}
+
+		if err := fb.write(pkt, p.prio); err != nil {
+			if pkt.msgType == typeSendDataWithAck {
+				bd.received.markDirty()
+			}
+			//fiber closed, try another one
+			LogDebug("[Bundle.transmit.writeFailed]", p.pkt.id, err)
+			continue
+		}
+		LogDebug("[Bundle.transmit.wrote]", p.pkt.id)
+
+		if p.copies > 1 {
+			bd.writeCopies(pkt, p.prio, fb, p.copies-1)
+		}
+
+		wheel.add(p, p.deadline)
+		return true
+	}
+}
+
+/*
+writeCopies writes duplicates of pkt on n fibers other than primary.
+Only the primary fiber is tracked for retransmission, copies are best effort,
+and they are not counted in flight of their fibers.
+*/
+func (bd *FiberBundle) writeCopies(pkt FiberPacket, prio Priority, primary *Fiber, n int) {
+	for _, fb := range bd.chooseOthers(primary, n) {
+		if err := fb.write(pkt, prio); err != nil {
+			LogDebug("[Bundle.writeCopies.writeFailed]", pkt.id, err)
+		}
+	}
+}
+
+/*
+setPendingFiber records that pending packet is (re-)written on fb, nil if it is no longer waiting.
+In-flight stats of fibers are updated accordingly.
+sendLock should be held.
+*/
+func (bd *FiberBundle) setPendingFiber(p *pendingPacket, fb *Fiber) {
+	if p.fiber != nil {
+		p.fiber.addInFlight(-1, p.size)
+	}
+	p.fiber = fb
+	if fb != nil {
+		fb.addInFlight(1, p.size)
+	}
+}
+
+/*
+nextPriority returns the highest priority queued, and if there is one.
+*/
+func nextPriority(queued *[numPriorities][]*pendingPacket) (Priority, bool) {
+	for i := range queued {
+		if len(queued[i]) > 0 {
+			return Priority(i), true
+		}
+	}
+	return numPriorities, false
+}
+
+/*
+nextToSend takes the first packet of priority prio in queued, and allocates ID for it.
+Stream header is filled as well, since it depends on the ID.
+*/
+func (bd *FiberBundle) nextToSend(queued *[numPriorities][]*pendingPacket, prio Priority) *pendingPacket {
+	p := queued[prio][0]
+	queued[prio][0] = nil
+	queued[prio] = queued[prio][1:]
+
+	flags := byte(p.prio) << flagPriorityShift
+	if p.more {
+		flags |= flagMoreFragments
+	}
+
+	bd.sendLock.Lock()
+	p.pkt.id = atomic.AddUint32(&(bd.seqs[upload]), 1) - 1
+	after := bd.nextInStream(p.stream, p.pkt.id)
+	putStreamHeader(p.pkt.message, p.stream, after, flags)
+	bd.inFlight[p.pkt.id] = p
+	bd.sendLock.Unlock()
+
+	if debugging() {
+		LogDebug("[Bundle.SendMessage] ", p.pkt.id, ShortHash(p.pkt.message))
+	}
+	return p
+}
+
+/*
+inPeerWindow tells if p fits in the window advertised by the other side.
+*/
+func (bd *FiberBundle) inPeerWindow(p *pendingPacket) bool {
+	bd.sendLock.RLock()
+	defer bd.sendLock.RUnlock()
+	return seqBefore(p.pkt.id, bd.peerEdge)
+}
+
+/*
+confirmPackets marks packets acknowledged by cumulative ID cum and ranges as sent,
+and moves the window to [cum, cum+window).
+Only IDs in flight are visited, so cost is not affected by malformed ranges.
+*/
+func (bd *FiberBundle) confirmPackets(cum uint32, window uint32, ranges []ackRange) {
+	now := time.Now()
+
+	bd.sendLock.Lock()
+	defer bd.sendLock.Unlock()
+
+	//IDs are allocated with sendLock held, so sendBase is never after next
+	next := atomic.LoadUint32(&bd.seqs[upload])
+
+	//cumulative part
+	//tokens are released only here, so IDs in flight never span over bufferLen,
+	//otherwise the other side would drop packets out of its window.
+	delivered := uint32(0)
+	for bd.sendBase != next && seqBefore(bd.sendBase, cum) {
+		bd.confirmOne(bd.sendBase, now)
+		bd.sendBase++
+		delivered++
+		bd.releaseToken()
+	}
+	if bd.sizer != nil && delivered > 0 {
+		bd.sizer.addDelivered(delivered, now, bd.rtt.getRTT())
+		bd.resizeWindow()
+	}
+
+	//selective part
+	for _, r := range ranges {
+		start := r.start
+		if seqBefore(start, bd.sendBase) {
+			start = bd.sendBase
+		}
+		for id := start; seqBefore(id, r.end) && seqBefore(id, next); id++ {
+			bd.confirmOne(id, now)
+		}
+	}
+
+	//packets sent on the window assumed at first, beyond the one advertised, were dropped by the other side.
+	//they are sent again as soon as the window has room for them, instead of after timeout.
+	if !bd.windowKnown {
+		bd.windowKnown = true
+		for id := bd.assumedBase + window; seqBefore(id, bd.peerEdge) && seqBefore(id, next); id++ {
+			if p, ok := bd.inFlight[id]; ok {
+				bd.overWindow = append(bd.overWindow, p)
+			}
+		}
+	}
+	for len(bd.overWindow) > 0 && seqBefore(bd.overWindow[0].pkt.id, cum+window) {
+		select {
+		case bd.resendNow <- bd.overWindow[0]:
+		default:
+		}
+		bd.overWindow = bd.overWindow[1:]
+	}
+
+	//window never shrinks, acknowledgements may arrive out of order
+	if edge := cum + window; seqBefore(bd.peerEdge, edge) {
+		bd.peerEdge = edge
+		notify(bd.windowOpened)
+	}
+}
+
+/*
+releaseToken frees the token of a confirmed packet,
+or keeps it reserved if the window should be smaller. sendLock should be held.
+*/
+func (bd *FiberBundle) releaseToken() {
+	if bd.sizer != nil && bd.bufferLen-bd.reserved > bd.sizer.window {
+		bd.reserved++
+		return
+	}
+	<-bd.sendTokens
+}
+
+/*
+resizeWindow reserves or frees tokens to approach the window wanted by sizer.
+Reserving only succeeds for free tokens, others are reserved when released. sendLock should be held.
+*/
+func (bd *FiberBundle) resizeWindow() {
+	for bd.bufferLen-bd.reserved > bd.sizer.window {
+		select {
+		case bd.sendTokens <- empty{}:
+			bd.reserved++
+		default:
+			//all in use
+			return
+		}
+	}
+	for bd.bufferLen-bd.reserved < bd.sizer.window {
+		//never blocks, reserved ones are in the channel
+		<-bd.sendTokens
+		bd.reserved--
+	}
+}
+
+/*
+confirmOne marks packet id as sent. sendLock should be held.
+*/
+func (bd *FiberBundle) confirmOne(id uint32, now time.Time) {
+	p, ok := bd.inFlight[id]
+	if !ok {
+		return
+	}
+	LogDebug("[Bundle.confirmOne]", id)
+
+	if p.attempts == 1 {
+		//Karn's algorithm: only sample packets sent once
+		sample := now.Sub(p.sentAt)
+		p.fiber.rtt.update(sample)
+		bd.rtt.update(sample)
+		if bd.sizer != nil {
+			bd.sizer.addRTT(sample, now)
+		}
+	}
+
+	p.done = true
+	fb := p.fiber
+	congested := false
+	if fb != nil {
+		congested = fb.congested()
+		fb.cc.onAcked(p.size, fb.InFlightBytes())
+	}
+	bd.setPendingFiber(p, nil)
+	delete(bd.inFlight, id)
+	if p.prio == PriorityBulk {
+		<-bd.bulkTokens
+	}
+
+	if congested && !fb.congested() {
+		bd.wakeFiberWaiters()
+	}
+}
+
+/*
+fiberLost makes packets written on fb (which is lost) resent immediately.
+*/
+func (bd *FiberBundle) fiberLost(fb *Fiber) {
+	select {
+	case bd.lostFibers <- fb:
+	case err := <-bd.closeChan:
+		bd.closeChan <- err
+	}
+}
@@ -48,8 +48,8 @@ func testOne(addr string, num int, bufSize uint32, msgCount int) {
 
 	conns := localConnPairs(addr, num)
 
-	hsrS := HandshakeResult{magicID, 1000000, 4000000, conns[0]}
-	hsrC := HandshakeResult{magicID, 1000000, 4000000, conns[num]}
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[num]}
 	encryptor := NewCedarCryptoIO("12345")
 
 	bdS := NewFiberBundle(bufSize, "server", &hsrS)
@@ -64,13 +64,13 @@ func testOne(addr string, num int, bufSize uint32, msgCount int) {
 	}
 	go func() {
 		for i := 0; i < msgCount; i++ {
-			bdC.SendMessage([]byte(message))
+			bdC.SendMessage([]byte(message), PriorityBulk)
 		}
 	}()
 
 	go func() {
 		for i := 0; i < msgCount; i++ {
-			bdS.SendMessage([]byte(message))
+			bdS.SendMessage([]byte(message), PriorityBulk)
 		}
 	}()
 
@@ -114,3 +114,351 @@ func TestBundleBasic(t *testing.T) {
 func TestBundleParallel(t *testing.T) {
 	testOne("127.0.0.1:20001", 3, 1, 100)
 }
+
+func TestBundleFiberLost(t *testing.T) {
+	numGoBeforeRun := runtime.NumGoroutine()
+
+	msgCount := 20
+	received := make(chan []byte, msgCount)
+
+	conns := localConnPairs("127.0.0.1:20004", 2)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[2]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bdS := NewFiberBundle(50, "server", &hsrS)
+	bdC := NewFiberBundle(50, "client", &hsrC)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+
+	//conns[1] is never read on server's side, packets written on it are lost
+	NewFiber(conns[0], encryptor, bdS)
+	NewFiber(conns[2], encryptor, bdC)
+	lostFiber := NewFiber(conns[3], encryptor, bdC)
+
+	//timeout on the lost fiber is long, messages must be resent because the fiber is lost
+	lostFiber.rtt.update(time.Hour)
+	timeout := boundRTO(time.Hour) / 2
+
+	for i := 0; i < msgCount; i++ {
+		bdC.SendMessage([]byte{byte(i)}, PriorityBulk)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	lostFiber.Close(nil)
+
+	deadline := time.After(timeout)
+	for i := 0; i < msgCount; i++ {
+		select {
+		case x := <-received:
+			if int(x[0]) != i {
+				panic("message out of order")
+			}
+		case <-deadline:
+			panic("packets on lost fiber are not resent")
+		}
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	conns[1].Close()
+
+	for end := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > numGoBeforeRun; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(end) {
+			panic("goroutine leakage")
+		}
+	}
+}
+
+func TestBundleFiberAdded(t *testing.T) {
+	received := make(chan []byte, 1)
+
+	conns := localConnPairs("127.0.0.1:20006", 1)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[1]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bdS := NewFiberBundle(10, "server", &hsrS)
+	bdC := NewFiberBundle(10, "client", &hsrC)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+
+	//no fiber yet, sending waits
+	bdC.SendMessage([]byte("hello"), PriorityBulk)
+	time.Sleep(200 * time.Millisecond)
+
+	NewFiber(conns[0], encryptor, bdS)
+	NewFiber(conns[1], encryptor, bdC)
+	start := time.Now()
+
+	select {
+	case <-received:
+		if time.Since(start) > 500*time.Millisecond {
+			panic("sending should resume as soon as fiber added")
+		}
+	case <-time.After(5 * time.Second):
+		panic("no message got and test failed")
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestBundleWindowMismatch(t *testing.T) {
+	msgCount := 200
+	received := make(chan []byte, msgCount)
+
+	conns := localConnPairs("127.0.0.1:20007", 1)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[1]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	//server accepts much less than client would send
+	bdS := NewFiberBundle(5, "server", &hsrS)
+	bdC := NewFiberBundle(100, "client", &hsrC)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		//slow consumer
+		time.Sleep(time.Millisecond)
+		received <- message
+	})
+	NewFiber(conns[0], encryptor, bdS)
+	NewFiber(conns[1], encryptor, bdC)
+
+	go func() {
+		for i := 0; i < msgCount; i++ {
+			bdC.SendMessage([]byte{byte(i)}, PriorityBulk)
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < msgCount; i++ {
+		select {
+		case x := <-received:
+			if int(x[0]) != i {
+				panic("message out of order")
+			}
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Time used:", time.Since(start), "(Packets should not be dropped and resent)")
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestBundleInitialWindow(t *testing.T) {
+	conns := localConnPairs("127.0.0.1:20020", 1)
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[1]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bd := NewFiberBundle(20, "client", &hsr)
+	fb := NewFiber(conns[1], encryptor, bd)
+
+	//the other side never acknowledges, IDs of data packets written are got here
+	written := make(chan uint32, 100)
+	go func() {
+		for {
+			msg, err := encryptor.ReadPacket(conns[0])
+			if err != nil {
+				return
+			}
+			pkts := []*FiberPacket{fb.unpack(msg)}
+			if pkts[0].msgType == typeBatch {
+				pkts, _ = fb.unpackBatch(pkts[0].message)
+			}
+			for _, pkt := range pkts {
+				if pkt.msgType == typeSendData {
+					written <- pkt.id
+				}
+			}
+		}
+	}()
+	//collect returns IDs written in a while, shorter than RTO
+	collect := func() []uint32 {
+		ret := make([]uint32, 0)
+		deadline := time.After(300 * time.Millisecond)
+		for {
+			select {
+			case id := <-written:
+				ret = append(ret, id)
+			case <-deadline:
+				return ret
+			}
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		bd.SendMessage([]byte{byte(i)}, PriorityBulk)
+	}
+	if len(collect()) != int(globalInitialWindow) {
+		panic("packets of the window assumed should be written before acknowledgement")
+	}
+
+	//the other side advertises a smaller window, packets beyond it are resent once it has room
+	bd.confirmPackets(4000000, 3, nil)
+	if len(collect()) != 0 {
+		panic("nothing should be written before the window has room")
+	}
+	bd.confirmPackets(4000003, 3, nil)
+	ids := collect()
+	if len(ids) != 3 || ids[0] != 4000003 || ids[2] != 4000005 {
+		panic("packets dropped by the other side should be resent at once")
+	}
+
+	bd.Close(nil)
+	conns[0].Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestBundleAutoWindow(t *testing.T) {
+	msgCount := 2000
+	received := make(chan []byte, msgCount)
+
+	conns := localConnPairs("127.0.0.1:20008", 2)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[2]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bdS := NewFiberBundle(200, "server", &hsrS)
+	bdC := NewFiberBundle(200, "client", &hsrC)
+	bdC.SetAutoWindow(2)
+	if bdC.Window() != 2 {
+		panic("window should start from min")
+	}
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+	for i := 0; i < 2; i++ {
+		NewFiber(conns[i], encryptor, bdS)
+		NewFiber(conns[i+2], encryptor, bdC)
+	}
+
+	go func() {
+		for i := 0; i < msgCount; i++ {
+			bdC.SendMessage([]byte{byte(i)}, PriorityBulk)
+		}
+	}()
+
+	for i := 0; i < msgCount; i++ {
+		select {
+		case x := <-received:
+			if x[0] != byte(i) {
+				panic("message out of order")
+			}
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+	if w := bdC.Window(); w < 2 || w > 200 {
+		panic("window out of bounds")
+	}
+	fmt.Println("Window:", bdC.Window())
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestBundleDuplication(t *testing.T) {
+	msgCount := 20
+	received := make(chan []byte, msgCount*2)
+
+	conns := localConnPairs("127.0.0.1:20011", 2)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[2]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bdS := NewFiberBundle(50, "server", &hsrS)
+	bdC := NewFiberBundle(50, "client", &hsrC)
+	bdC.SetDuplication(2)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+
+	//conns[1] is never read on server's side, only copies on the other fiber arrive
+	NewFiber(conns[0], encryptor, bdS)
+	NewFiber(conns[2], encryptor, bdC)
+	NewFiber(conns[3], encryptor, bdC)
+
+	start := time.Now()
+	for i := 0; i < msgCount; i++ {
+		bdC.SendMessage([]byte{byte(i)}, PriorityBulk)
+	}
+	for i := 0; i < msgCount; i++ {
+		select {
+		case x := <-received:
+			if int(x[0]) != i {
+				panic("message out of order")
+			}
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+	if time.Since(start) > globalInitialRTO/2 {
+		t.Error("Time used:", time.Since(start), "(Copies should arrive without retransmission)")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-received:
+		panic("duplicated message forwarded")
+	default:
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	conns[1].Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestBundlePriority(t *testing.T) {
+	msgCount := 300
+	received := make(chan []byte, msgCount+1)
+
+	conns := localConnPairs("127.0.0.1:20013", 1)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[1]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bdS := NewFiberBundle(8, "server", &hsrS)
+	bdC := NewFiberBundle(8, "client", &hsrC)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+	NewFiber(conns[0], encryptor, bdS)
+	NewFiber(conns[1], encryptor, bdC)
+
+	go func() {
+		for i := 0; i < msgCount; i++ {
+			bdC.SendMessage([]byte("bulk"), PriorityBulk)
+		}
+	}()
+
+	//bulk messages are in progress, interactive one should not wait for all of them
+	<-received
+	bdC.SendMessage([]byte("interactive"), PriorityInteractive)
+
+	for i := 1; i < msgCount+1; i++ {
+		select {
+		case x := <-received:
+			if string(x) == "interactive" {
+				if i > msgCount/2 {
+					t.Error("Position:", i, "(Interactive message should go ahead of bulk ones)")
+				}
+			}
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
@@ -0,0 +1,124 @@
+package bundle
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+Packets coalesced are sent as one packet of typeBatch, whose message is:
+	([length 4B][packed packet xB])*
+Packets in it are packed just like those sent alone, but batches are not nested.
+*/
+
+/*
+SetCoalescing makes small packets on each fiber added afterwards written in one record.
+delay is the latency budget: how long a small packet waits for others.
+0 means only packets already queued are coalesced, and it is disabled if delay < 0.
+*/
+func (bd *FiberBundle) SetCoalescing(delay time.Duration) {
+	bd.fibersLock.Lock()
+	bd.coalesce = delay
+	bd.fibersLock.Unlock()
+}
+
+func (bd *FiberBundle) coalescing() time.Duration {
+	bd.fibersLock.RLock()
+	defer bd.fibersLock.RUnlock()
+	return bd.coalesce
+}
+
+func batchEntryLen(f *FiberPacket) int {
+	return 4 + 5 + len(f.message)
+}
+
+/*
+recordLen returns size of packets in batch packed as one record.
+*/
+func recordLen(batch []FiberPacket) int {
+	if len(batch) == 1 {
+		return 5 + len(batch[0].message)
+	}
+	size := 5
+	for i := range batch {
+		size += batchEntryLen(&batch[i])
+	}
+	return size
+}
+
+/*
+coalesce appends packets queued to batch, which has one small packet, until the record is full.
+It waits for them no longer than coalesceDelay.
+Packet taken but not fit is returned, it should be written next.
+*/
+func (fb *Fiber) coalesce(batch []FiberPacket) ([]FiberPacket, *FiberPacket) {
+	size := 5 + batchEntryLen(&batch[0])
+	if fb.coalesceDelay < 0 || size >= globalCoalesceMax {
+		return batch, nil
+	}
+
+	var timeout <-chan time.Time
+	if fb.coalesceDelay > 0 {
+		timer := time.NewTimer(fb.coalesceDelay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		f, ok := fb.nextQueued()
+		if !ok && timeout != nil {
+			f, ok = fb.waitQueued(timeout)
+		}
+		if !ok {
+			return batch, nil
+		}
+		if size+batchEntryLen(&f) > globalCoalesceMax {
+			return batch, &f
+		}
+		batch = append(batch, f)
+		size += batchEntryLen(&f)
+	}
+}
+
+/*
+packRecord packs packets in batch into buf, of recordLen(batch) bytes.
+*/
+func (fb *Fiber) packRecord(buf []byte, batch []FiberPacket) {
+	if len(batch) == 1 {
+		fb.packTo(buf, &batch[0])
+		return
+	}
+
+	buf[0] = uint8(typeBatch)
+	binary.BigEndian.PutUint32(buf[1:5], 0)
+	pos := 5
+	for i := range batch {
+		f := &batch[i]
+		binary.BigEndian.PutUint32(buf[pos:pos+4], uint32(5+len(f.message)))
+		fb.packTo(buf[pos+4:], f)
+		pos += batchEntryLen(f)
+	}
+}
+
+/*
+unpackBatch gets packets back from message of a typeBatch packet.
+*/
+func (fb *Fiber) unpackBatch(msg []byte) ([]*FiberPacket, error) {
+	ret := make([]*FiberPacket, 0)
+	for len(msg) > 0 {
+		if len(msg) < 4 {
+			return nil, errFiberRead
+		}
+		size := binary.BigEndian.Uint32(msg[0:4])
+		if size < 5 || uint64(size) > uint64(len(msg)-4) {
+			return nil, errFiberRead
+		}
+		pkt := fb.unpack(msg[4 : 4+size])
+		if pkt.msgType == typeBatch || pkt.msgType == typeRekey {
+			return nil, errFiberRead
+		}
+		ret = append(ret, pkt)
+		msg = msg[4+size:]
+	}
+	return ret, nil
+}
@@ -0,0 +1,91 @@
+package bundle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPackRecord(t *testing.T) {
+	fb := &Fiber{}
+	batch := []FiberPacket{
+		{1, typeSendData, []byte("first")},
+		{2, typeDataReceived, []byte{}},
+		{3, typeSendData, bytes.Repeat([]byte{3}, 100)},
+	}
+
+	record := make([]byte, recordLen(batch))
+	fb.packRecord(record, batch)
+	pkt := fb.unpack(record)
+	if pkt.msgType != typeBatch {
+		panic("packets should be coalesced")
+	}
+	pkts, err := fb.unpackBatch(pkt.message)
+	if err != nil || len(pkts) != len(batch) {
+		panic("batch error")
+	}
+	for i, p := range pkts {
+		if p.id != batch[i].id || p.msgType != batch[i].msgType || !bytes.Equal(p.message, batch[i].message) {
+			panic("packet in batch error")
+		}
+	}
+
+	//single packet is packed as it is
+	record = make([]byte, recordLen(batch[:1]))
+	fb.packRecord(record, batch[:1])
+	if pkt := fb.unpack(record); pkt.msgType != typeSendData || string(pkt.message) != "first" {
+		panic("single packet error")
+	}
+
+	bad := [][]byte{
+		{0, 0, 0},
+		{0, 0, 0, 4, 1, 0, 0, 0},
+		{0, 0, 0, 9, 1, 0, 0, 0, 1},
+		{0, 0, 0, 5, uint8(typeBatch), 0, 0, 0, 0},
+	}
+	for _, msg := range bad {
+		if _, err := fb.unpackBatch(msg); err == nil {
+			panic("illegal batch should be rejected")
+		}
+	}
+}
+
+func TestBundleCoalescing(t *testing.T) {
+	msgCount := 200
+	received := make(chan []byte, msgCount)
+
+	conns := localConnPairs("127.0.0.1:20015", 1)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[1]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bdS := NewFiberBundle(50, "server", &hsrS)
+	bdC := NewFiberBundle(50, "client", &hsrC)
+	bdS.SetCoalescing(2 * time.Millisecond)
+	bdC.SetCoalescing(2 * time.Millisecond)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+	NewFiber(conns[0], encryptor, bdS)
+	NewFiber(conns[1], encryptor, bdC)
+
+	go func() {
+		for i := 0; i < msgCount; i++ {
+			bdC.SendMessage(bytes.Repeat([]byte{byte(i)}, i%50), PriorityInteractive)
+		}
+	}()
+	for i := 0; i < msgCount; i++ {
+		select {
+		case x := <-received:
+			if !bytes.Equal(x, bytes.Repeat([]byte{byte(i)}, i%50)) {
+				panic("message error")
+			}
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
@@ -0,0 +1,85 @@
+package bundle
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+congestionControl limits bytes in flight on one fiber, with AIMD like TCP Reno:
+
+	slow start:           cwnd += acked bytes, while cwnd < ssthresh
+	congestion avoidance: cwnd += MSS * acked bytes / cwnd
+	timeout:              ssthresh = cwnd / 2, cwnd = ssthresh
+
+Window decreases at most once per RTT, as packets written together are usually lost together.
+It grows only when it is really used, so an idle fiber does not get an unbounded window.
+*/
+type congestionControl struct {
+	lock         sync.RWMutex
+	cwnd         int64
+	ssthresh     int64
+	lastDecrease time.Time
+}
+
+func newCongestionControl() *congestionControl {
+	ret := new(congestionControl)
+	ret.cwnd = globalInitialCwnd
+	ret.ssthresh = globalMaxCwnd
+	return ret
+}
+
+/*
+onAcked is called when size bytes are confirmed, inFlight is bytes in flight before that.
+*/
+func (cc *congestionControl) onAcked(size int64, inFlight int64) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	if inFlight*2 < cc.cwnd {
+		//not limited by window
+		return
+	}
+
+	if cc.cwnd < cc.ssthresh {
+		cc.cwnd += size
+	} else {
+		inc := globalCwndMSS * size / cc.cwnd
+		if inc < 1 {
+			inc = 1
+		}
+		cc.cwnd += inc
+	}
+	if cc.cwnd > globalMaxCwnd {
+		cc.cwnd = globalMaxCwnd
+	}
+}
+
+/*
+onTimeout is called when a packet written on the fiber timed out.
+*/
+func (cc *congestionControl) onTimeout(now time.Time, rtt time.Duration) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	if now.Sub(cc.lastDecrease) < rtt {
+		return
+	}
+	cc.lastDecrease = now
+
+	cc.ssthresh = cc.cwnd / 2
+	if cc.ssthresh < globalMinCwnd {
+		cc.ssthresh = globalMinCwnd
+	}
+	cc.cwnd = cc.ssthresh
+	LogDebug("[congestionControl.onTimeout]", cc.cwnd)
+}
+
+/*
+window returns congestion window in bytes.
+*/
+func (cc *congestionControl) window() int64 {
+	cc.lock.RLock()
+	defer cc.lock.RUnlock()
+	return cc.cwnd
+}
@@ -0,0 +1,96 @@
+package bundle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCongestionControl(t *testing.T) {
+	cc := newCongestionControl()
+	if cc.window() != globalInitialCwnd {
+		panic("initial window error")
+	}
+
+	//not limited by window, no growth
+	cc.onAcked(1000, 0)
+	if cc.window() != globalInitialCwnd {
+		panic("window should not grow when not used")
+	}
+
+	//slow start
+	cc.onAcked(1000, cc.window())
+	if cc.window() != globalInitialCwnd+1000 {
+		panic("window should grow by acked bytes in slow start")
+	}
+
+	//multiplicative decrease, once per RTT
+	now := time.Now()
+	before := cc.window()
+	cc.onTimeout(now, 100*time.Millisecond)
+	if cc.window() != before/2 {
+		panic("window should be halved on timeout")
+	}
+	cc.onTimeout(now.Add(10*time.Millisecond), 100*time.Millisecond)
+	if cc.window() != before/2 {
+		panic("window should be halved at most once per RTT")
+	}
+
+	//congestion avoidance, about one MSS per window
+	before = cc.window()
+	for acked := int64(0); acked < before; acked += 1000 {
+		cc.onAcked(1000, cc.window())
+	}
+	if inc := cc.window() - before; inc < globalCwndMSS/2 || inc > globalCwndMSS*2 {
+		t.Error("Increment:", inc, "(Should be about one MSS)")
+	}
+
+	//lower bound
+	for i := 1; i <= 20; i++ {
+		cc.onTimeout(now.Add(time.Duration(i)*time.Second), 100*time.Millisecond)
+	}
+	if cc.window() != globalMinCwnd {
+		panic("window should not be lower than globalMinCwnd")
+	}
+}
+
+func TestCongestedFiberSkipped(t *testing.T) {
+	conns := localConnPairs("127.0.0.1:20009", 2)
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[2]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bd := NewFiberBundle(10, "client", &hsr)
+	full := NewFiber(conns[2], encryptor, bd)
+	free := NewFiber(conns[3], encryptor, bd)
+
+	full.addInFlight(1, full.CongestionWindow())
+	for i := 0; i < 10; i++ {
+		if bd.getFiberToSend() != free {
+			panic("congested fiber should be skipped")
+		}
+	}
+
+	//all congested: one is still returned after RTO
+	free.addInFlight(1, free.CongestionWindow())
+	start := time.Now()
+	if bd.getFiberToSend() == nil {
+		panic("a fiber should be returned")
+	}
+	if time.Since(start) < bd.rtt.getRTO()/2 {
+		panic("should wait for congestion window")
+	}
+
+	//window opens
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		free.addInFlight(-1, free.CongestionWindow())
+		bd.wakeFiberWaiters()
+	}()
+	if bd.getFiberToSend() != free {
+		panic("fiber with window opened should be returned")
+	}
+
+	bd.Close(nil)
+	conns[0].Close()
+	conns[1].Close()
+	time.Sleep(100 * time.Millisecond)
+}
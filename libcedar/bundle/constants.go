@@ -13,6 +13,10 @@ const (
 	typeSendData
 	typeDataReceived
 	typeHeartbeat
+	typeSendDataWithAck //typeSendData with acknowledgement piggybacked
+	typeFECParity       //parity of a group of typeSendData packets
+	typeBatch           //packets coalesced into one record
+	typeRekey           //keys are rotated after it, id is the new epoch
 )
 
 const (
@@ -28,7 +32,9 @@ var errAddingFailed = errors.New("adding failed")
 const (
 	defaultTimeout     time.Duration = time.Second * 60
 	defaultResend      time.Duration = time.Second * 15
-	defaultConfirmWait time.Duration = time.Millisecond * 1
+	defaultConfirmWait time.Duration = time.Millisecond * 5
+	defaultMinRTO      time.Duration = time.Millisecond * 200
+	defaultInitialRTO  time.Duration = time.Second * 1
 )
 
 /*
@@ -40,7 +46,35 @@ var GlobalConnectionTimeout = defaultTimeout
 var globalResend = defaultResend
 var globalMinHeartbeat = time.Second * 10
 var globalMaxHeartbeat = defaultResend
-var globalConfirmWait = defaultConfirmWait
+var globalConfirmWait = defaultConfirmWait //max delay of acknowledgement
+var globalAckEvery = 8                     //acknowledge at once after this number of packets
+var globalInitialWindow uint32 = 8         //window assumed before the other side advertises one, in packets as globalInitialCwnd
+var globalMinRTO = defaultMinRTO
+var globalInitialRTO = defaultInitialRTO
+var globalFiberQueueLen = 64
+var globalWheelTick = time.Millisecond * 10
+var globalWheelSize = 512
+var globalWindowGain = 2.0                       //auto window is this times of bandwidth-delay product
+var globalWindowInterval = time.Millisecond * 50 //min interval between two auto window samples
+var globalMinRTTExpire = time.Second * 10        //min RTT is measured again after this
+var globalCwndMSS int64 = 8192
+var globalInitialCwnd = 8 * globalCwndMSS
+var globalMinCwnd = 2 * globalCwndMSS
+var globalMaxCwnd int64 = 64 * 1024 * 1024
+var globalShapingBurst = time.Millisecond * 100 //bucket of a shaped fiber holds tokens of this period
+var globalJitterPeriod = time.Second            //rate of a shaped fiber changes after this
+var globalFECMaxShards = 64                     //max number of data and parity packets in a group
+var globalFECMaxGroups = 256                    //max number of groups waiting for reconstruction
+var globalFECFlush = time.Millisecond * 20      //parity of a group not full is sent after this
+var globalMTU = 16 * 1024                       //max size of message in one data packet, larger ones are fragmented
+var globalMaxMessage = 4 * 1024 * 1024          //max size of a message, after reassembly
+var globalMinMTU = 1024                         //MTU is never smaller, even to fit a max frame
+var globalFrameOverhead = 16 * 1024             //room for headers and piggybacked acknowledgement in a packet
+var globalMaxFrame = globalMTU + globalFrameOverhead
+var globalCoalesceMax = 4096         //max size of a record of coalesced packets
+var globalRekeyBytes int64 = 1 << 30 //session keys are rotated after this number of bytes
+var globalRekeyInterval = time.Hour  //or after this
+var globalRekeyMaxStep uint32 = 16   //max epochs ahead of the latest derived
 
 func SetGlobalTimeout(duration time.Duration) {
 	if duration < 0 {
@@ -49,6 +83,10 @@ func SetGlobalTimeout(duration time.Duration) {
 	GlobalConnectionTimeout = duration
 }
 
+/*
+SetGlobalResend sets the upper bound of retransmission timeout.
+Actual timeout is computed from measured RTT of each fiber.
+*/
 func SetGlobalResend(duration time.Duration) {
 	if duration < 0 {
 		duration = 3600 * time.Second //one hour
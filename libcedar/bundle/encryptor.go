@@ -7,7 +7,9 @@ import (
 	"crypto/sha512"
 	"encoding/binary"
 	"errors"
+	"hash"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -16,6 +18,11 @@ ErrIllegalPacket is returned when an illegal packet is received.
 */
 var ErrIllegalPacket = errors.New("packet is illegal")
 
+/*
+ErrFrameTooLarge is returned when a packet is larger than the max frame size.
+*/
+var ErrFrameTooLarge = errors.New("frame too large")
+
 const (
 	epochStart  = int64(0x5a83c811)
 	timeDiffTol = 600 // Tolerance of time difference between two machine, +/- ten minutes
@@ -40,6 +47,28 @@ type CryptoIO interface {
 	WritePacket(conn io.ReadWriter, msg []byte) (int, error)
 	ReadPacket(conn io.ReadWriter) ([]byte, error)
 	SetKey(password string)
+	SetMaxFrameSize(size int)
+	Derive(key []byte) CryptoIO
+}
+
+/*
+FrameIO is implemented by CryptoIO which encrypts packets in place, so that they are not copied.
+A frame has FrameHead bytes reserved before the message, and FrameTail bytes after it.
+*/
+type FrameIO interface {
+	FrameHead() int
+	FrameTail() int
+	WriteFrame(conn io.Writer, frame []byte, msgLen int) (int, error)
+}
+
+/*
+SequencedIO is implemented by CryptoIO which binds a packet to its position in a stream, like records of TLS.
+Position (see Fiber.position) is in associated data of the packet, and reader checks it by its own count.
+So packets replayed, dropped, reordered, or moved from another stream or direction, are refused.
+*/
+type SequencedIO interface {
+	WriteFrameAt(conn io.Writer, frame []byte, msgLen int, position []byte) (int, error)
+	ReadPacketAt(conn io.ReadWriter, position []byte) ([]byte, error)
 }
 
 /*
@@ -51,14 +80,27 @@ type CedarCryptoIO struct {
 
 	macKey []byte
 	ivPad  []byte
+	kdf    KDF //of SetKey
+
+	maxFrame uint32 //max length of message in a packet
+	scratch  sync.Pool
 }
 
 /*
-NewCedarCryptoIO create a new CedarCryptoIO.
+NewCedarCryptoIO create a new CedarCryptoIO, with keys from password by SimpleKDF.
 */
 func NewCedarCryptoIO(password string) *CedarCryptoIO {
+	return NewCedarCryptoIOWithKDF(password, SimpleKDF{})
+}
+
+/*
+NewCedarCryptoIOWithKDF create a new CedarCryptoIO, with keys from password by kdf.
+*/
+func NewCedarCryptoIOWithKDF(password string, kdf KDF) *CedarCryptoIO {
 	ret := new(CedarCryptoIO)
+	ret.kdf = kdf
 	ret.SetKey(password)
+	ret.SetMaxFrameSize(0)
 
 	return ret
 }
@@ -67,76 +109,205 @@ func NewCedarCryptoIO(password string) *CedarCryptoIO {
 SetKey sets password for CedarCryptoIO.
 */
 func (ce *CedarCryptoIO) SetKey(password string) {
+	//KDF here is used for strengthening keys and deriving (irrelevant) keys from same password.
+	ce.setKeys(func(salt string, bit int) []byte {
+		return ce.kdf.Generate(password, salt, bit)
+	})
+}
+
+/*
+Derive returns a new CedarCryptoIO whose keys are derived from key of a session, instead of password.
+*/
+func (ce *CedarCryptoIO) Derive(key []byte) CryptoIO {
+	ret := new(CedarCryptoIO)
+	ret.setKeys(func(info string, bit int) []byte {
+		return expandKey(key, info, bit)
+	})
+	ret.maxFrame = ce.maxFrame
+
+	return ret
+}
+
+func (ce *CedarCryptoIO) setKeys(generate func(salt string, bit int) []byte) {
 	//encryption algorithm is aes-256-cbc
 	//mac: hmac-sha512(trunc to 64), mac-then-encrypt
-	//KDF here is used for strengthening keys and deriving (irrelevant) keys from same password.
+	ce.ivCipher, _ = aes.NewCipher(generate("cedar/ivKey", 256))
+	ce.msgCipher, _ = aes.NewCipher(generate("cedar/msgKey", 256))
+
+	ce.macKey = generate("cedar/macKey", 512)
+	ce.ivPad = generate("cedar/ivPad", 64)
+}
 
-	k := SimpleKDF{}
-	ce.ivCipher, _ = aes.NewCipher(k.Generate(password, "cedar/ivKey", 256))
-	ce.msgCipher, _ = aes.NewCipher(k.Generate(password, "cedar/msgKey", 256))
+/*
+SetMaxFrameSize sets the max length of message in a packet, 0 means the default.
+Larger packets are refused before anything is allocated for them.
+*/
+func (ce *CedarCryptoIO) SetMaxFrameSize(size int) {
+	if size <= 0 {
+		size = globalMaxFrame
+	}
+	ce.maxFrame = uint32(size)
+}
+
+/*
+Packet format of CedarCryptoIO:
 
-	ce.macKey = k.Generate(password, "cedar/macKey", 512)
-	ce.ivPad = k.Generate(password, "cedar/ivPad", 64)
+	[fake_iv 8B]([hmac 8B][timestamp 4B][length 4B][message xB][padding])
 
-	return
+Part in brackets is encrypted by aes-256-cbc, IV is derived from fake_iv.
+*/
+const (
+	cedarBlockSize = 16
+	cedarFakeIVLen = 8
+	cedarHeadLen   = 8 + 4 + 4
+	cedarFrameHead = cedarFakeIVLen + cedarHeadLen
+	cedarFrameTail = cedarBlockSize - 1
+)
+
+/*
+cedarScratch is state reused for writing or reading packets, so that they do not allocate.
+*/
+type cedarScratch struct {
+	macKey   []byte //mac is for this key
+	mac      hash.Hash
+	sig      []byte
+	received []byte //hmac received
+	iv       []byte
+	head     []byte
+	enc      cipher.BlockMode
+	dec      cipher.BlockMode
 }
 
 /*
-WritePacket writes a block of encrypted message to conn.
-It returns the size actually wrote (larger than len(msg)) and error.
+ivSetter is implemented by block modes of standard library, so that they are reused for a new IV.
 */
-func (ce CedarCryptoIO) WritePacket(conn io.ReadWriter, msg []byte) (int, error) {
-	//TODO: Add support of session key
-	//KeySize := 32 //256-bit
-	BlockSize := 16
-	FakeIVLength := 8
+type ivSetter interface {
+	SetIV([]byte)
+}
 
-	if aes.BlockSize != BlockSize {
-		panic("blocksize should be aes.blocksize")
+func (ce *CedarCryptoIO) getScratch() *cedarScratch {
+	if v := ce.scratch.Get(); v != nil {
+		sc := v.(*cedarScratch)
+		//keys might be changed by SetKey
+		if &sc.macKey[0] == &ce.macKey[0] {
+			return sc
+		}
 	}
+	sc := new(cedarScratch)
+	sc.macKey = ce.macKey
+	sc.mac = hmac.New(sha512.New, ce.macKey)
+	sc.sig = make([]byte, 0, sha512.Size)
+	sc.received = make([]byte, 8)
+	sc.iv = make([]byte, cedarBlockSize)
+	sc.head = make([]byte, cedarFrameHead)
+	return sc
+}
 
-	//half padding (from ivPad), half random. Random part would be sent.
-	//create fake IV
-	fakeIV := make([]byte, FakeIVLength)
-	DefaultRNG.Read(fakeIV)
+func (ce *CedarCryptoIO) putScratch(sc *cedarScratch) {
+	ce.scratch.Put(sc)
+}
 
-	//concat fake IV with IV padding
-	iv := make([]byte, BlockSize)
-	copy(iv[0:8], ce.ivPad)
-	copy(iv[8:BlockSize], fakeIV)
+/*
+encrypter returns CBC encrypter of msgCipher with iv of sc.
+*/
+func (ce *CedarCryptoIO) encrypter(sc *cedarScratch) cipher.BlockMode {
+	if s, ok := sc.enc.(ivSetter); ok {
+		s.SetIV(sc.iv)
+		return sc.enc
+	}
+	sc.enc = cipher.NewCBCEncrypter(ce.msgCipher, sc.iv)
+	return sc.enc
+}
 
-	//encrypt iv with ivKey.
-	ce.ivCipher.Encrypt(iv, iv)
+/*
+decrypter returns CBC decrypter of msgCipher with iv of sc.
+*/
+func (ce *CedarCryptoIO) decrypter(sc *cedarScratch) cipher.BlockMode {
+	if s, ok := sc.dec.(ivSetter); ok {
+		s.SetIV(sc.iv)
+		return sc.dec
+	}
+	sc.dec = cipher.NewCBCDecrypter(ce.msgCipher, sc.iv)
+	return sc.dec
+}
 
-	//head = ([fake_iv 8B]) [hmac 8B][timestamp 4B][length 4B]
-	HeadLength := 8 + 4 + 4
-	HeadIVLen := FakeIVLength + HeadLength
+/*
+deriveIV sets iv of sc from fake IV of a packet: half padding (from ivPad), half from packet.
+*/
+func (ce *CedarCryptoIO) deriveIV(sc *cedarScratch, fakeIV []byte) {
+	copy(sc.iv[0:8], ce.ivPad)
+	copy(sc.iv[8:cedarBlockSize], fakeIV)
+	ce.ivCipher.Encrypt(sc.iv, sc.iv)
+}
 
-	newLength := FakeIVLength + (HeadLength+len(msg)+(BlockSize-1))/BlockSize*BlockSize
-	paddedMsg := make([]byte, newLength)
+/*
+FrameHead returns bytes reserved before the message in a frame.
+*/
+func (ce *CedarCryptoIO) FrameHead() int {
+	return cedarFrameHead
+}
+
+/*
+FrameTail returns bytes reserved after the message in a frame.
+*/
+func (ce *CedarCryptoIO) FrameTail() int {
+	return cedarFrameTail
+}
+
+/*
+WritePacket writes a block of encrypted message to conn.
+It returns the size actually wrote (larger than len(msg)) and error.
+*/
+func (ce *CedarCryptoIO) WritePacket(conn io.ReadWriter, msg []byte) (int, error) {
+	buf := getBuffer(cedarFrameHead + len(msg) + cedarFrameTail)
+	defer buf.release()
+
+	copy(buf.bytes[cedarFrameHead:], msg)
+	return ce.WriteFrame(conn, buf.bytes, len(msg))
+}
+
+/*
+WriteFrame encrypts frame in place, and writes it to conn.
+Message of msgLen bytes is after FrameHead bytes in frame, and frame has FrameTail bytes after it.
+It returns the size actually wrote and error.
+*/
+func (ce *CedarCryptoIO) WriteFrame(conn io.Writer, frame []byte, msgLen int) (int, error) {
+	if uint64(msgLen) > uint64(ce.maxFrame) {
+		return 0, ErrFrameTooLarge
+	}
+
+	sc := ce.getScratch()
+	defer ce.putScratch(sc)
+
+	newLength := cedarFakeIVLen + (cedarHeadLen+msgLen+(cedarBlockSize-1))/cedarBlockSize*cedarBlockSize
+	paddedMsg := frame[:newLength]
+
+	//half padding (from ivPad), half random. Random part would be sent.
+	fakeIV := paddedMsg[0:cedarFakeIVLen]
+	DefaultRNG.Read(fakeIV)
+	ce.deriveIV(sc, fakeIV)
 
 	//Read random data, fill padding
-	DefaultRNG.Read(paddedMsg[HeadIVLen+len(msg):])
+	DefaultRNG.Read(paddedMsg[cedarFrameHead+msgLen:])
 
 	//Fill all part, leave hmac zero
-	copy(paddedMsg[0:8], fakeIV)
+	binary.BigEndian.PutUint64(paddedMsg[8:16], 0)
 	binary.BigEndian.PutUint32(paddedMsg[16:20], timestamp())
-	binary.BigEndian.PutUint32(paddedMsg[20:24], uint32(len(msg)))
-	copy(paddedMsg[HeadIVLen:], msg)
+	binary.BigEndian.PutUint32(paddedMsg[20:24], uint32(msgLen))
 
 	//compute hmac
-	author := hmac.New(sha512.New, ce.macKey)
-	author.Write(paddedMsg)
-	sig := author.Sum(nil)
+	sc.mac.Reset()
+	sc.mac.Write(paddedMsg)
+	sig := sc.mac.Sum(sc.sig[:0])
 	copy(paddedMsg[8:16], sig[:8])
 
 	//then encrypt
-	coder := cipher.NewCBCEncrypter(ce.msgCipher, iv)
-	coder.CryptBlocks(paddedMsg[FakeIVLength:], paddedMsg[FakeIVLength:])
+	ce.encrypter(sc).CryptBlocks(paddedMsg[cedarFakeIVLen:], paddedMsg[cedarFakeIVLen:])
 
-	ffid := binary.BigEndian.Uint32(msg[1:5])
-	if ffid != 0 {
-		defer LogDebug("[Encryptor.Wrote]", ffid)
+	if debugging() && msgLen >= 5 {
+		if ffid := binary.BigEndian.Uint32(frame[cedarFrameHead+1 : cedarFrameHead+5]); ffid != 0 {
+			defer LogDebug("[Encryptor.Wrote]", ffid)
+		}
 	}
 	return conn.Write(paddedMsg)
 }
@@ -146,65 +317,54 @@ ReadPacket reads a packet of encrypted message from conn.
 It returns the []byte got and error.
 When any error occur, the []byte returned is nil.
 */
-func (ce CedarCryptoIO) ReadPacket(conn io.ReadWriter) ([]byte, error) {
-	// KeySize := 32 //256-bit
-	BlockSize := 16
-	FakeIVLength := BlockSize - 8
-	HeadLength := 8 + 4 + 4
-	HeadIVLen := HeadLength + FakeIVLength
-
-	if aes.BlockSize != BlockSize {
-		panic("blocksize should be aes.blocksize")
-	}
+func (ce *CedarCryptoIO) ReadPacket(conn io.ReadWriter) ([]byte, error) {
+	sc := ce.getScratch()
+	defer ce.putScratch(sc)
 
 	//fast check header: if magic str is gone, drop it
-	fastCheck := make([]byte, HeadIVLen)
+	fastCheck := sc.head
 	_, err := io.ReadFull(conn, fastCheck)
 	if err != nil {
 		//Early returns cause time-based attack possible. (do not care)
 		return nil, err
 	}
 
-	//half padding (from ivPad), half from packet.
-	iv := make([]byte, BlockSize)
-	copy(iv[0:8], ce.ivPad)
-	copy(iv[8:BlockSize], fastCheck)
-
-	//encrypt iv with ivKey.
-	ce.ivCipher.Encrypt(iv, iv)
-
-	//if session Key is allocated, use it.
-	//otherwise, use commonKey.
-	coder := cipher.NewCBCDecrypter(ce.msgCipher, iv)
+	ce.deriveIV(sc, fastCheck[0:cedarFakeIVLen])
+	coder := ce.decrypter(sc)
 
 	//head = ([fake_iv 8B]) [hmac 8B][timestamp 4B][length 4B]
-	coder.CryptBlocks(fastCheck[FakeIVLength:HeadIVLen], fastCheck[FakeIVLength:HeadIVLen])
-	if !timeMatch(binary.BigEndian.Uint32(fastCheck[FakeIVLength+8 : FakeIVLength+12])) {
+	coder.CryptBlocks(fastCheck[cedarFakeIVLen:cedarFrameHead], fastCheck[cedarFakeIVLen:cedarFrameHead])
+	if !timeMatch(binary.BigEndian.Uint32(fastCheck[16:20])) {
 		return nil, ErrIllegalPacket
 	}
 
-	msgLen := binary.BigEndian.Uint32(fastCheck[FakeIVLength+12 : FakeIVLength+16])
-	newLength := FakeIVLength + (HeadLength+int(msgLen)+(BlockSize-1))/BlockSize*BlockSize
+	msgLen := binary.BigEndian.Uint32(fastCheck[20:24])
+	if msgLen > ce.maxFrame {
+		//length is not authenticated yet, do not trust it
+		return nil, ErrFrameTooLarge
+	}
+	newLength := cedarFakeIVLen + (cedarHeadLen+int(msgLen)+(cedarBlockSize-1))/cedarBlockSize*cedarBlockSize
+
+	//the only allocation, message returned is in it
 	paddedMsg := make([]byte, newLength)
 	copy(paddedMsg, fastCheck)
 
-	n, err := io.ReadFull(conn, paddedMsg[HeadIVLen:])
-	if err != nil || n != len(paddedMsg)-HeadIVLen {
+	n, err := io.ReadFull(conn, paddedMsg[cedarFrameHead:])
+	if err != nil || n != len(paddedMsg)-cedarFrameHead {
 		return nil, ErrIllegalPacket
 	}
-	coder.CryptBlocks(paddedMsg[HeadIVLen:], paddedMsg[HeadIVLen:])
+	coder.CryptBlocks(paddedMsg[cedarFrameHead:], paddedMsg[cedarFrameHead:])
 
 	//check hmac
-	transferSig := make([]byte, 8)
-	copy(transferSig, paddedMsg[FakeIVLength:FakeIVLength+8])
-	binary.BigEndian.PutUint64(paddedMsg[FakeIVLength:FakeIVLength+8], 0)
-
-	author := hmac.New(sha512.New, ce.macKey)
-	author.Write(paddedMsg)
-	sig := author.Sum(nil)
-	if !hmac.Equal(sig[0:8], transferSig) {
+	copy(sc.received, paddedMsg[8:16])
+	binary.BigEndian.PutUint64(paddedMsg[8:16], 0)
+
+	sc.mac.Reset()
+	sc.mac.Write(paddedMsg)
+	sig := sc.mac.Sum(sc.sig[:0])
+	if !hmac.Equal(sig[0:8], sc.received) {
 		return nil, ErrIllegalPacket
 	}
 
-	return paddedMsg[HeadIVLen : HeadIVLen+int(msgLen)], nil
+	return paddedMsg[cedarFrameHead : cedarFrameHead+int(msgLen)], nil
 }
@@ -47,3 +47,89 @@ func TestCedarEncryptor(t *testing.T) {
 
 	return
 }
+
+func TestCedarEncryptorFrameSize(t *testing.T) {
+	writer := NewCedarCryptoIO("test_test_test")
+	reader := NewCedarCryptoIO("test_test_test")
+	reader.SetMaxFrameSize(100)
+
+	frw := bytes.NewBuffer(nil)
+	writer.WritePacket(frw, make([]byte, 1000))
+	if _, err := reader.ReadPacket(frw); err != ErrFrameTooLarge {
+		panic("large frame should be refused")
+	}
+
+	writer.SetMaxFrameSize(100)
+	if _, err := writer.WritePacket(frw, make([]byte, 101)); err != ErrFrameTooLarge {
+		panic("large frame should not be written")
+	}
+}
+
+/*
+replayConn reads the same data again and again, and drops what is written.
+*/
+type replayConn struct {
+	data []byte
+	pos  int
+}
+
+func (c *replayConn) Read(buf []byte) (int, error) {
+	if c.pos == len(c.data) {
+		c.pos = 0
+	}
+	n := copy(buf, c.data[c.pos:])
+	c.pos += n
+	return n, nil
+}
+
+func (c *replayConn) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (c *replayConn) Close() error {
+	return nil
+}
+
+const benchmarkMessageLen = 8192
+
+func BenchmarkCedarWritePacket(b *testing.B) {
+	encryptor := NewCedarCryptoIO("test_test_test")
+	msg := make([]byte, benchmarkMessageLen)
+	conn := new(replayConn)
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkMessageLen)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encryptor.WritePacket(conn, msg)
+	}
+}
+
+func BenchmarkCedarWriteFrame(b *testing.B) {
+	encryptor := NewCedarCryptoIO("test_test_test")
+	frame := make([]byte, encryptor.FrameHead()+benchmarkMessageLen+encryptor.FrameTail())
+	conn := new(replayConn)
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkMessageLen)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encryptor.WriteFrame(conn, frame, benchmarkMessageLen)
+	}
+}
+
+func BenchmarkCedarReadPacket(b *testing.B) {
+	encryptor := NewCedarCryptoIO("test_test_test")
+	frw := bytes.NewBuffer(nil)
+	encryptor.WritePacket(frw, make([]byte, benchmarkMessageLen))
+	conn := &replayConn{frw.Bytes(), 0}
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkMessageLen)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := encryptor.ReadPacket(conn); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package bundle
 
 import (
 	"net"
+	"time"
 )
 
 type Endpoint struct {
@@ -12,13 +13,39 @@ type Endpoint struct {
 	endpointType string
 	encryptor    CryptoIO
 	handshaker   *Handshaker
+	password     string
+	cipherName   string
+	kdfs         []KDF             //the first one is used
+	user         string            //ID of user of multi-user server, of client
+	users        map[string]string //secrets of users by their IDs, of multi-user server
+	scheduler    FiberScheduler
+	minWindow    uint32 //auto window if not 0
+	shaping      FiberShaping
+	copies       int
+	fecData      int
+	fecParity    int
+	mtu          int //default if 0
+	maxMessage   int //default if 0
+	maxFrame     int //fits mtu if 0
+	budget       *memoryBudget
+	coalesce     time.Duration
+	rekeyBytes   int64
+	rekeyAfter   time.Duration
 
 	onReceived   FuncDataReceived
 	onFiberLost  FuncFiberLost
 	onBundleLost FuncBundleLost
 }
 
-func NewEndpoint(bufferLen uint32, endpointType string, addr string, password string) *Endpoint {
+/*
+NewEndpoint creates a new Endpoint, whose connections are encrypted by cipher (see NewCryptoIO) with password.
+*/
+func NewEndpoint(bufferLen uint32, endpointType string, addr string, password string, cipherName string) *Endpoint {
+	encryptor, err := NewCryptoIO(cipherName, password)
+	if err != nil {
+		panic("unknown cipher: " + cipherName)
+	}
+
 	n := new(Endpoint)
 
 	n.bufferLen = bufferLen
@@ -26,8 +53,14 @@ func NewEndpoint(bufferLen uint32, endpointType string, addr string, password st
 	n.bundles = NewBundleCollection()
 	n.endpointType = endpointType
 	n.addr = addr
-	n.encryptor = NewCedarCryptoIO(password)
+	n.encryptor = encryptor
+	n.password = password
+	n.cipherName = cipherName
+	n.kdfs = []KDF{SimpleKDF{}}
 	n.handshaker = NewHandshaker(n.encryptor, n.bundles)
+	n.budget = newMemoryBudget(0)
+	n.rekeyBytes = globalRekeyBytes
+	n.rekeyAfter = globalRekeyInterval
 
 	return n
 }
@@ -54,6 +87,7 @@ func (ep *Endpoint) ServerStart() {
 			hsr, err := ep.handshaker.ConfirmHandshake(conn)
 			if err != nil {
 				LogDebug("Confirm failed:", err)
+				conn.Close()
 				return
 			}
 			LogDebug("[Endpoint.handshaked]", hsr.id)
@@ -61,12 +95,32 @@ func (ep *Endpoint) ServerStart() {
 
 			if bd == nil {
 				bd = NewFiberBundle(ep.bufferLen, "server", &hsr)
+				bd.encryptor = ep.encryptor.Derive(hsr.key)
 				bd.SetOnReceived(ep.onReceived)
 				bd.SetOnBundleLost(ep.onBundleLost)
 				bd.SetOnFiberLost(ep.onFiberLost)
+				if ep.scheduler != nil {
+					bd.SetScheduler(ep.scheduler)
+				}
+				if ep.minWindow != 0 {
+					bd.SetAutoWindow(ep.minWindow)
+				}
+				bd.SetShaping(ep.shaping)
+				if ep.copies > 1 {
+					bd.SetDuplication(ep.copies)
+				}
+				if ep.fecData > 0 {
+					bd.SetFEC(ep.fecData, ep.fecParity)
+				}
+				bd.SetMTU(ep.mtu)
+				bd.SetMaxFrameSize(ep.frameSize())
+				bd.SetMaxMessageSize(ep.maxMessage)
+				bd.setMemoryBudget(ep.budget)
+				bd.SetCoalescing(ep.coalesce)
+				bd.SetRekeying(ep.rekeyBytes, ep.rekeyAfter)
 				ep.bundles.AddBundle(bd)
 			}
-			NewFiber(hsr.conn, ep.encryptor, bd)
+			newFiber(hsr.conn, bd.encryptor, bd, hsr.nonce)
 		}()
 	}
 }
@@ -87,13 +141,37 @@ func (ep *Endpoint) CreateConnection(numberOfConnections int) {
 	LogDebug("Connected", ep.addr, conn)
 
 	hsr, err := ep.handshaker.RequestNewBundle(conn)
-	LogDebug("request", hsr, err)
+	LogDebug("request", hsr.id, err)
+	if err != nil {
+		conn.Close()
+		return
+	}
 
 	bd := NewFiberBundle(ep.bufferLen, "client", &hsr)
+	bd.encryptor = ep.encryptor.Derive(hsr.key)
 	bd.SetOnReceived(ep.onReceived)
 	bd.SetOnBundleLost(ep.onBundleLost)
 	bd.SetOnFiberLost(ep.onFiberLost)
-	NewFiber(hsr.conn, ep.encryptor, bd)
+	if ep.scheduler != nil {
+		bd.SetScheduler(ep.scheduler)
+	}
+	if ep.minWindow != 0 {
+		bd.SetAutoWindow(ep.minWindow)
+	}
+	bd.SetShaping(ep.shaping)
+	if ep.copies > 1 {
+		bd.SetDuplication(ep.copies)
+	}
+	if ep.fecData > 0 {
+		bd.SetFEC(ep.fecData, ep.fecParity)
+	}
+	bd.SetMTU(ep.mtu)
+	bd.SetMaxFrameSize(ep.frameSize())
+	bd.SetMaxMessageSize(ep.maxMessage)
+	bd.setMemoryBudget(ep.budget)
+	bd.SetCoalescing(ep.coalesce)
+	bd.SetRekeying(ep.rekeyBytes, ep.rekeyAfter)
+	newFiber(hsr.conn, bd.encryptor, bd, hsr.nonce)
 
 	err = ep.bundles.AddBundle(bd)
 	if err != nil {
@@ -111,16 +189,31 @@ func (ep *Endpoint) AddConnection() {
 	if err != nil {
 		return
 	}
-	id := ep.bundles.GetMain().id
-	_, err = ep.handshaker.RequestAddToBundle(conn, id)
+	bd := ep.bundles.GetMain()
+	if bd == nil {
+		conn.Close()
+		return
+	}
+	hsr, err := ep.handshaker.RequestAddToBundle(conn, bd.id)
 	if err != nil {
+		conn.Close()
 		return
 	}
-	NewFiber(conn, ep.encryptor, ep.bundles.GetMain())
+	newFiber(conn, bd.encryptor, bd, hsr.nonce)
+}
+
+func (ep *Endpoint) Write(id uint32, message []byte, prio Priority) {
+	ep.WriteStream(id, 0, message, prio)
 }
 
-func (ep *Endpoint) Write(id uint32, message []byte) {
-	LogDebug("[Endpoint.Write]", ShortHash(message))
+/*
+WriteStream writes message to bundle id, on the given stream.
+Messages of different streams do not wait for each other when some are lost.
+*/
+func (ep *Endpoint) WriteStream(id uint32, stream uint32, message []byte, prio Priority) {
+	if debugging() {
+		LogDebug("[Endpoint.Write]", ShortHash(message))
+	}
 
 	var x *FiberBundle
 
@@ -128,7 +221,7 @@ func (ep *Endpoint) Write(id uint32, message []byte) {
 	if x == nil {
 		panic("write failed because no bundle exists")
 	}
-	x.SendMessage(message)
+	x.SendStreamMessage(stream, message, prio)
 	return
 }
 
@@ -143,3 +236,170 @@ func (ep *Endpoint) SetOnBundleLost(f FuncBundleLost) {
 func (ep *Endpoint) SetOnFiberLost(f FuncFiberLost) {
 	ep.onFiberLost = f
 }
+
+/*
+SetScheduler sets the scheduler used by bundles created afterwards.
+*/
+func (ep *Endpoint) SetScheduler(s FiberScheduler) {
+	ep.scheduler = s
+}
+
+/*
+SetAutoWindow makes bundles created afterwards adjust their window automatically,
+between minWindow and bufferLen of the endpoint. 0 means the window is fixed to bufferLen.
+*/
+func (ep *Endpoint) SetAutoWindow(minWindow uint32) {
+	ep.minWindow = minWindow
+}
+
+/*
+SetShaping limits the rate of each connection of bundles created afterwards.
+*/
+func (ep *Endpoint) SetShaping(s FiberShaping) {
+	ep.shaping = s
+}
+
+/*
+SetDuplication makes bundles created afterwards write each data packet to k fibers.
+*/
+func (ep *Endpoint) SetDuplication(k int) {
+	ep.copies = k
+}
+
+/*
+SetFEC makes bundles created afterwards send m parity packets for each k data packets.
+*/
+func (ep *Endpoint) SetFEC(k int, m int) {
+	ep.fecData, ep.fecParity = k, m
+}
+
+/*
+SetFragmentation makes bundles created afterwards fragment messages larger than mtu,
+and refuse messages larger than maxMessageSize. 0 means the default.
+*/
+func (ep *Endpoint) SetFragmentation(mtu int, maxMessageSize int) {
+	ep.mtu, ep.maxMessage = mtu, maxMessageSize
+	ep.updateFrameSize()
+}
+
+/*
+SetMaxFrameSize sets the max length of a packet read from or written to connections.
+Larger ones are refused before anything is allocated. 0 means it just fits MTU.
+It is sent in handshakes, and both sides fragment messages to fit the smaller one.
+*/
+func (ep *Endpoint) SetMaxFrameSize(size int) {
+	ep.maxFrame = size
+	ep.updateFrameSize()
+}
+
+/*
+frameSize returns the max frame of this side, with room for a message of globalMinMTU at least.
+*/
+func (ep *Endpoint) frameSize() int {
+	size := ep.maxFrame
+	if size <= 0 {
+		mtu := ep.mtu
+		if mtu <= 0 {
+			mtu = globalMTU
+		}
+		size = mtu + globalFrameOverhead
+	}
+	if size < globalMinMTU+globalFrameOverhead {
+		size = globalMinMTU + globalFrameOverhead
+	}
+	return size
+}
+
+func (ep *Endpoint) updateFrameSize() {
+	ep.encryptor.SetMaxFrameSize(ep.frameSize())
+	ep.handshaker.SetMaxFrameSize(ep.frameSize())
+}
+
+/*
+SetMemoryBudget limits bytes of packets received out of order, of all bundles together.
+They are dropped when it is used up, and the other side sends them again later.
+Packets could be forwarded at once are always taken, counted in the budget but not limited by it.
+So the budget does not bound memory held for a slow consumer, which is bounded by bufferLen of each bundle.
+0 means no limit.
+*/
+func (ep *Endpoint) SetMemoryBudget(bytes int64) {
+	ep.budget.setLimit(bytes)
+}
+
+/*
+SetKDF sets KDF of keys from password, which protect handshakes.
+Client uses the first one. Server accepts all of them, so that clients could migrate one by one.
+By default, only SimpleKDF is used. It should be called before connections are created.
+*/
+func (ep *Endpoint) SetKDF(kdfs ...KDF) {
+	if len(kdfs) == 0 {
+		return
+	}
+	ep.kdfs = kdfs
+	ep.updateHandshaker()
+}
+
+/*
+SetUser makes client connect to a multi-user server as user id, whose secret is the password.
+ID is not sent, server finds it by a tag from both of them. It should be called before connections are created.
+*/
+func (ep *Endpoint) SetUser(id string) {
+	ep.user = id
+	ep.updateHandshaker()
+}
+
+/*
+SetUsers makes server multi-user, with secrets of users by their IDs. Password of the endpoint is not used then.
+Clients must call SetUser. ID of the user of a bundle is got by BundleUser.
+It should be called before ServerStart.
+*/
+func (ep *Endpoint) SetUsers(users map[string]string) {
+	ep.users = users
+	ep.updateHandshaker()
+}
+
+/*
+BundleUser returns ID of the user of bundle id, or "" if not multi-user or no such bundle.
+*/
+func (ep *Endpoint) BundleUser(id uint32) string {
+	bd := ep.bundles.GetBundle(id)
+	if bd == nil {
+		return ""
+	}
+	return bd.User()
+}
+
+func (ep *Endpoint) newEncryptor(password string, kdf KDF) CryptoIO {
+	encryptor, _ := NewCryptoIOWithKDF(ep.cipherName, password, kdf)
+	return encryptor
+}
+
+func (ep *Endpoint) updateHandshaker() {
+	for i, kdf := range ep.kdfs {
+		if i == 0 {
+			ep.handshaker.UseKDF(kdf, ep.newEncryptor(ep.password, kdf))
+		} else {
+			ep.handshaker.AcceptKDF(kdf, ep.newEncryptor(ep.password, kdf))
+		}
+	}
+	if ep.user != "" {
+		ep.handshaker.SetUser(ep.user, ep.password, ep.kdfs[0])
+	}
+	ep.handshaker.SetUsers(ep.users, ep.newEncryptor)
+}
+
+/*
+SetCoalescing makes small packets written in one record, waiting at most delay for each other.
+0 means only packets already queued are coalesced, and it is disabled if delay < 0.
+*/
+func (ep *Endpoint) SetCoalescing(delay time.Duration) {
+	ep.coalesce = delay
+}
+
+/*
+SetRekeying makes session keys of bundles created afterwards rotated after bytes written, or interval passed.
+0 means never for either of them. By default, they are rotated after 1GB or an hour.
+*/
+func (ep *Endpoint) SetRekeying(bytes int64, interval time.Duration) {
+	ep.rekeyBytes, ep.rekeyAfter = bytes, interval
+}
@@ -0,0 +1,258 @@
+package bundle
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+Forward error correction with systematic Reed-Solomon code over GF(2^8).
+
+A group is k consecutive data packets, m parity packets are generated over it.
+Any k of the k+m shards are enough to reconstruct the group, so up to m packets lost
+(e.g. with a dead fiber) are recovered without waiting for retransmission.
+
+Data shard i is [length 4B][message of packet first+i], zero padded to the longest one.
+Parity shards are rows of a Cauchy matrix times data shards, any square submatrix of it is invertible.
+
+Message of a parity packet (id of the packet is the first ID of the group):
+
+	[k 1B][m 1B][index 1B][shard]
+*/
+
+var errFECTooManyLost = errors.New("too many shards lost")
+
+var gfExp [512]byte
+var gfLog [256]byte
+
+func init() {
+	//generator 2, polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+/*
+gfMulAdd computes dst += c * src.
+*/
+func gfMulAdd(dst []byte, c byte, src []byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(gfLog[c])
+	for i, v := range src {
+		if v != 0 {
+			dst[i] ^= gfExp[lc+int(gfLog[v])]
+		}
+	}
+}
+
+/*
+fecCoefficient returns coefficient of data shard j in parity shard i, of group with k data shards.
+*/
+func fecCoefficient(k int, i int, j int) byte {
+	//Cauchy matrix 1 / (x_i + y_j), with x_i = k + i and y_j = j all distinct
+	return gfInv(byte(k+i) ^ byte(j))
+}
+
+/*
+fecShards makes data shards from messages.
+*/
+func fecShards(messages [][]byte) [][]byte {
+	size := 0
+	for _, msg := range messages {
+		if len(msg)+4 > size {
+			size = len(msg) + 4
+		}
+	}
+
+	ret := make([][]byte, len(messages))
+	for i, msg := range messages {
+		ret[i] = fecShard(msg, size)
+	}
+	return ret
+}
+
+/*
+fecShard makes a data shard of size bytes, nil if msg is too long for it.
+*/
+func fecShard(msg []byte, size int) []byte {
+	if len(msg)+4 > size {
+		return nil
+	}
+	ret := make([]byte, size)
+	binary.BigEndian.PutUint32(ret[0:4], uint32(len(msg)))
+	copy(ret[4:], msg)
+	return ret
+}
+
+/*
+fecMessage gets message back from a data shard, nil if shard is malformed.
+*/
+func fecMessage(shard []byte) []byte {
+	if len(shard) < 4 {
+		return nil
+	}
+	n := binary.BigEndian.Uint32(shard[0:4])
+	if uint64(n) > uint64(len(shard)-4) {
+		return nil
+	}
+	return shard[4 : 4+n]
+}
+
+/*
+fecEncode returns m parity shards of data shards (of same length).
+*/
+func fecEncode(data [][]byte, m int) [][]byte {
+	k := len(data)
+	ret := make([][]byte, m)
+	for i := range ret {
+		ret[i] = make([]byte, len(data[0]))
+		for j, shard := range data {
+			gfMulAdd(ret[i], fecCoefficient(k, i, j), shard)
+		}
+	}
+	return ret
+}
+
+/*
+fecReconstruct fills nil shards of data, from the others and parity (nil if lost).
+All shards given should be of same length.
+*/
+func fecReconstruct(data [][]byte, parity [][]byte) error {
+	k := len(data)
+
+	//choose k shards available, described by their rows in the encoding matrix
+	rows := make([][]byte, 0, k)
+	shards := make([][]byte, 0, k)
+	size := 0
+	for j, shard := range data {
+		if shard != nil {
+			row := make([]byte, k)
+			row[j] = 1
+			rows = append(rows, row)
+			shards = append(shards, shard)
+			size = len(shard)
+		}
+	}
+	if len(rows) == k {
+		return nil
+	}
+	for i, shard := range parity {
+		if len(rows) == k {
+			break
+		}
+		if shard != nil {
+			row := make([]byte, k)
+			for j := range row {
+				row[j] = fecCoefficient(k, i, j)
+			}
+			rows = append(rows, row)
+			shards = append(shards, shard)
+			size = len(shard)
+		}
+	}
+	if len(rows) < k {
+		return errFECTooManyLost
+	}
+
+	inv, err := gfInvertMatrix(rows)
+	if err != nil {
+		return err
+	}
+	for j := range data {
+		if data[j] != nil {
+			continue
+		}
+		data[j] = make([]byte, size)
+		for r, shard := range shards {
+			gfMulAdd(data[j], inv[j][r], shard)
+		}
+	}
+	return nil
+}
+
+/*
+gfInvertMatrix inverts a square matrix with Gauss-Jordan elimination. The matrix is modified.
+*/
+func gfInvertMatrix(a [][]byte) ([][]byte, error) {
+	n := len(a)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if a[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errFECTooManyLost
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		c := gfInv(a[col][col])
+		for j := 0; j < n; j++ {
+			a[col][j] = gfMul(a[col][j], c)
+			inv[col][j] = gfMul(inv[col][j], c)
+		}
+		for r := 0; r < n; r++ {
+			if r != col && a[r][col] != 0 {
+				c := a[r][col]
+				gfMulAdd(a[r], c, a[col])
+				gfMulAdd(inv[r], c, inv[col])
+			}
+		}
+	}
+	return inv, nil
+}
+
+/*
+parityMessage makes message of a parity packet.
+*/
+func parityMessage(k int, m int, index int, shard []byte) []byte {
+	ret := make([]byte, 3+len(shard))
+	ret[0], ret[1], ret[2] = byte(k), byte(m), byte(index)
+	copy(ret[3:], shard)
+	return ret
+}
+
+/*
+parseParityMessage parses message generated by parityMessage.
+*/
+func parseParityMessage(msg []byte) (int, int, int, []byte, error) {
+	if len(msg) < 3+4 {
+		return 0, 0, 0, nil, ErrIllegalPacket
+	}
+	k, m, index := int(msg[0]), int(msg[1]), int(msg[2])
+	if k < 1 || m < 1 || index >= m || k+m > globalFECMaxShards {
+		return 0, 0, 0, nil, ErrIllegalPacket
+	}
+	return k, m, index, msg[3:], nil
+}
@@ -0,0 +1,172 @@
+package bundle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReedSolomon(t *testing.T) {
+	k, m := 5, 3
+	messages := make([][]byte, k)
+	for i := range messages {
+		messages[i] = make([]byte, 10+i*7)
+		DefaultRNG.Read(messages[i])
+	}
+	data := fecShards(messages)
+	parity := fecEncode(data, m)
+
+	//every combination of up to m lost shards
+	for mask := 0; mask < 1<<uint(k+m); mask++ {
+		lost := 0
+		for i := 0; i < k+m; i++ {
+			if mask&(1<<uint(i)) != 0 {
+				lost++
+			}
+		}
+
+		d := make([][]byte, k)
+		p := make([][]byte, m)
+		for i := 0; i < k+m; i++ {
+			if mask&(1<<uint(i)) != 0 {
+				continue
+			}
+			if i < k {
+				d[i] = data[i]
+			} else {
+				p[i-k] = parity[i-k]
+			}
+		}
+
+		err := fecReconstruct(d, p)
+		if lost > m {
+			if err == nil {
+				panic("too many shards lost")
+			}
+			continue
+		}
+		if err != nil {
+			panic("reconstruction failed")
+		}
+		for i := range d {
+			if !bytes.Equal(fecMessage(d[i]), messages[i]) {
+				panic("reconstructed message error")
+			}
+		}
+	}
+
+	if _, _, _, _, err := parseParityMessage([]byte{4, 2, 2, 0, 0, 0, 0}); err == nil {
+		panic("illegal parity index should be rejected")
+	}
+}
+
+func TestSetFEC(t *testing.T) {
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000}
+	bd := NewFiberBundle(50, "server", &hsr)
+
+	for _, c := range [][4]int{{4, 2, 4, 2}, {0, 2, 0, 2}, {4, 0, 0, 0}, {60, 10, 54, 10}, {4, 100, 1, 63}, {4, 64, 1, 63}} {
+		bd.SetFEC(c[0], c[1])
+		if bd.fecData != c[2] || (c[2] > 0 && bd.fecParity != c[3]) {
+			panic("FEC should be clamped to a valid group")
+		}
+	}
+}
+
+func TestBundleFECReceived(t *testing.T) {
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000}
+	bd := NewFiberBundle(50, "server", &hsr)
+	received := make(chan []byte, 20)
+	bd.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+
+	k, m := 4, 2
+	messages := make([][]byte, 2*k)
+	for i := range messages {
+		messages[i] = bytes.Repeat([]byte{byte(i)}, 1+i)
+	}
+	//all on stream 0, each after the previous one
+	packets := make([][]byte, len(messages))
+	for i := range messages {
+		packets[i] = streamMessage(0, 1, 0, messages[i])
+	}
+	packets[0] = streamMessage(0, 0, 0, messages[0])
+	first := uint32(4000000)
+	parity := [][][]byte{
+		fecEncode(fecShards(packets[:k]), m),
+		fecEncode(fecShards(packets[k:]), m),
+	}
+	send := func(i int) {
+		bd.PacketReceived(&FiberPacket{first + uint32(i), typeSendData, packets[i]})
+	}
+	sendParity := func(g int, i int) {
+		msg := parityMessage(k, m, i, parity[g][i])
+		bd.PacketReceived(&FiberPacket{first + uint32(g*k), typeFECParity, msg})
+	}
+
+	//group 0: 1 and 2 lost, 0 is forwarded before parity arrives
+	send(0)
+	send(3)
+	time.Sleep(50 * time.Millisecond)
+	sendParity(0, 0)
+	sendParity(0, 1)
+
+	//group 1: 5 lost, one parity is enough
+	send(4)
+	send(6)
+	send(7)
+	sendParity(1, 1)
+
+	for i := range messages {
+		select {
+		case x := <-received:
+			if !bytes.Equal(x, messages[i]) {
+				panic("message error")
+			}
+		case <-time.After(time.Second):
+			panic("lost packets are not reconstructed")
+		}
+	}
+
+	bd.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestBundleFEC(t *testing.T) {
+	msgCount := 100
+	received := make(chan []byte, msgCount)
+
+	conns := localConnPairs("127.0.0.1:20012", 1)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[1]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bdS := NewFiberBundle(50, "server", &hsrS)
+	bdC := NewFiberBundle(50, "client", &hsrC)
+	bdC.SetFEC(4, 2)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+	NewFiber(conns[0], encryptor, bdS)
+	NewFiber(conns[1], encryptor, bdC)
+
+	go func() {
+		for i := 0; i < msgCount; i++ {
+			bdC.SendMessage(bytes.Repeat([]byte{byte(i)}, i), PriorityBulk)
+		}
+	}()
+	for i := 0; i < msgCount; i++ {
+		select {
+		case x := <-received:
+			if !bytes.Equal(x, bytes.Repeat([]byte{byte(i)}, i)) {
+				panic("message error")
+			}
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
@@ -25,13 +25,32 @@ type FiberPacket struct {
 }
 
 type Fiber struct {
-	conn      io.ReadWriteCloser
-	encryptor CryptoIO
-	bundle    *FiberBundle
+	conn       io.ReadWriteCloser
+	encryptor  CryptoIO //of writing
+	decryptor  CryptoIO //of reading, different from encryptor when keys are being rotated
+	writeEpoch uint32   //of keys, see rekeyState
+	readEpoch  uint32
+	bundle     *FiberBundle
+
+	stream   uint64                  //nonce of handshake of the fiber, tells fibers apart
+	writeSeq uint64                  //of the next record written
+	readSeq  uint64                  //of the next record read
+	writeBuf [recordPositionLen]byte //position of record written, see Fiber.position
+	readBuf  [recordPositionLen]byte //of record read
 
 	lastRead  int64
 	lastWrite int64
 
+	rtt           *rttEstimator
+	cc            *congestionControl
+	shaper        *tokenBucket  //nil if rate is not limited
+	coalesceDelay time.Duration //how long a small packet waits for others to write together, never if < 0
+	inFlight      int64         //number of packets written but not confirmed
+	inFlightBytes int64
+	writeLatency  int64 //smoothed duration of write, in nanoseconds
+
+	writeQueues [numPriorities]chan FiberPacket //packets waiting for keepWriting, by priority
+
 	closeSignal chan error
 	cleaned     uint32
 }
@@ -40,21 +59,51 @@ var errFiberWrite = errors.New("failure during writing")
 var errFiberRead = errors.New("failure during reading")
 var ErrConnectionTimeout = errors.New("connection timeout")
 
+/*
+NewFiber creates a fiber of bundle on conn, whose records are encrypted by encryptor.
+Its stream is 0, see Fiber.position.
+*/
 func NewFiber(conn io.ReadWriteCloser, encryptor CryptoIO, bundle *FiberBundle) *Fiber {
+	return newFiber(conn, encryptor, bundle, 0)
+}
+
+/*
+newFiber creates a fiber with nonce of its handshake as stream, see Fiber.position.
+*/
+func newFiber(conn io.ReadWriteCloser, encryptor CryptoIO, bundle *FiberBundle, stream uint64) *Fiber {
 	ret := new(Fiber)
 
 	ret.conn = conn
 	ret.encryptor = encryptor
+	ret.decryptor = encryptor
+	ret.writeEpoch = 0
+	ret.readEpoch = 0
 	ret.bundle = bundle
+	ret.stream = stream
+	ret.writeSeq = 0
+	ret.readSeq = 0
 
 	ret.lastRead = time.Now().Unix()
 	ret.lastWrite = time.Now().Unix()
 
+	ret.rtt = newRttEstimator()
+	ret.cc = newCongestionControl()
+	ret.shaper = nil
+	ret.coalesceDelay = 0
+	if bundle != nil {
+		ret.shaper = bundle.newShaper()
+		ret.coalesceDelay = bundle.coalescing()
+	}
+	for i := range ret.writeQueues {
+		ret.writeQueues[i] = make(chan FiberPacket, globalFiberQueueLen)
+	}
+
 	ret.closeSignal = make(chan error, 88)
 	ret.cleaned = 0
 
 	go ret.keepHeartbeating()
 	go ret.keepReading()
+	go ret.keepWriting()
 
 	if bundle != nil {
 		bundle.FiberCreated(ret)
@@ -102,24 +151,115 @@ func (fb *Fiber) keepReading() {
 			return
 		}
 
-		if fb.bundle != nil {
-			fb.bundle.PacketReceived(pkt)
+		if pkt.msgType == typeRekey {
+			if err := fb.rekeyRead(pkt.id); err != nil {
+				fb.Close(err)
+				return
+			}
+			continue
+		}
+		if pkt.msgType == typeBatch {
+			pkts, err := fb.unpackBatch(pkt.message)
+			if err != nil {
+				fb.Close(err)
+				return
+			}
+			for _, p := range pkts {
+				fb.packetReceived(p)
+			}
+			continue
 		}
+		fb.packetReceived(pkt)
 	}
 }
 
-func (fb *Fiber) sendHeartbeat() {
-	fb.write(FiberPacket{0, typeHeartbeat, nil})
+func (fb *Fiber) packetReceived(pkt *FiberPacket) {
+	if fb.bundle != nil {
+		fb.bundle.PacketReceived(pkt)
+	}
 }
 
-func (fb *Fiber) pack(f *FiberPacket) []byte {
-	ret := make([]byte, len(f.message)+1+4)
+/*
+keepWriting is the only goroutine writing on conn of the fiber.
+Packets of higher priority are written first, those of the same priority are written in the order they are queued.
+Small packets are coalesced into one record. The rate is limited by shaper. Fiber is closed on any error.
+*/
+func (fb *Fiber) keepWriting() {
+	batch := make([]FiberPacket, 0, 16)
+	var carried *FiberPacket //taken from queues, but not fit in the last record
 
-	ret[0] = uint8(f.msgType)
-	binary.BigEndian.PutUint32(ret[1:5], f.id)
-	copy(ret[5:], f.message)
+	for {
+		var f FiberPacket
+		if carried != nil {
+			f, carried = *carried, nil
+		} else {
+			var ok bool
+			if f, ok = fb.nextQueued(); !ok {
+				f, ok = fb.waitQueued(nil)
+			}
+			if !ok || fb.IsClosed() {
+				return
+			}
+		}
 
-	return ret
+		batch, carried = fb.coalesce(append(batch[:0], f))
+		if fb.IsClosed() {
+			return
+		}
+
+		if fb.shaper != nil {
+			wait := fb.shaper.take(recordLen(batch), time.Now())
+			if wait > 0 {
+				select {
+				case err := <-fb.closeSignal:
+					fb.closeSignal <- err
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		err := fb.rekeyWrite()
+		if err == nil {
+			err = fb.writeRecord(batch)
+		}
+		if err != nil {
+			fb.Close(err)
+			return
+		}
+	}
+}
+
+/*
+waitQueued waits for a queued packet of the highest priority.
+It returns false if the fiber is closed, or timeout fires.
+*/
+func (fb *Fiber) waitQueued(timeout <-chan time.Time) (FiberPacket, bool) {
+	var f FiberPacket
+	select {
+	case err := <-fb.closeSignal:
+		fb.closeSignal <- err
+		return f, false
+	case <-timeout:
+		return f, false
+	case f = <-fb.writeQueues[PriorityControl]:
+	case f = <-fb.writeQueues[PriorityInteractive]:
+	case f = <-fb.writeQueues[PriorityBulk]:
+	}
+	return f, true
+}
+
+func (fb *Fiber) sendHeartbeat() {
+	fb.write(FiberPacket{0, typeHeartbeat, nil}, PriorityControl)
+}
+
+/*
+packTo packs f into buf, which has len(f.message)+5 bytes at least.
+*/
+func (fb *Fiber) packTo(buf []byte, f *FiberPacket) {
+	buf[0] = uint8(f.msgType)
+	binary.BigEndian.PutUint32(buf[1:5], f.id)
+	copy(buf[5:], f.message)
 }
 
 func (fb *Fiber) unpack(msg []byte) *FiberPacket {
@@ -131,9 +271,45 @@ func (fb *Fiber) unpack(msg []byte) *FiberPacket {
 	return ret
 }
 
+/*
+Position of a record, associated data of it if the encryptor is SequencedIO:
+
+	[stream 8B][direction 1B][sequence 8B]
+
+Records of each direction are numbered from 0, across epochs of keys.
+*/
+const recordPositionLen = 8 + 1 + 8
+
+/*
+position returns position of record seq written by client (or server), in buf.
+*/
+func (fb *Fiber) position(buf *[recordPositionLen]byte, fromClient bool, seq uint64) []byte {
+	binary.BigEndian.PutUint64(buf[0:8], fb.stream)
+	buf[8] = 's'
+	if fromClient {
+		buf[8] = 'c'
+	}
+	binary.BigEndian.PutUint64(buf[9:17], seq)
+	return buf[:]
+}
+
+/*
+isClient tells if fb is of a client bundle.
+*/
+func (fb *Fiber) isClient() bool {
+	return fb.bundle != nil && fb.bundle.bundleType == clientBundle
+}
+
 func (fb *Fiber) read() (*FiberPacket, error) {
 	//LogDebug("[Fiber.read.reading]", fb)
-	msg, err := fb.encryptor.ReadPacket(fb.conn)
+	var msg []byte
+	var err error
+	if sio, ok := fb.decryptor.(SequencedIO); ok {
+		msg, err = sio.ReadPacketAt(fb.conn, fb.position(&fb.readBuf, !fb.isClient(), fb.readSeq))
+	} else {
+		msg, err = fb.decryptor.ReadPacket(fb.conn)
+	}
+	fb.readSeq++
 
 	if err != nil {
 		//panic("read error should not happen") //for debug
@@ -141,7 +317,7 @@ func (fb *Fiber) read() (*FiberPacket, error) {
 	}
 	ret := fb.unpack(msg)
 
-	if ret.msgType == typeSendData {
+	if debugging() && ret.msgType == typeSendData {
 		LogDebug("[Fiber.read]", ret.id)
 	}
 
@@ -150,22 +326,160 @@ func (fb *Fiber) read() (*FiberPacket, error) {
 	return ret, nil
 }
 
-func (fb *Fiber) write(f FiberPacket) error {
-	packed := fb.pack(&f)
-	n, err := fb.encryptor.WritePacket(fb.conn, packed)
-	if f.msgType == typeSendData {
-		LogDebug("[Fiber.write]", f.id)
+/*
+write queues a packet for writing.
+It blocks if the queue is full, and returns errFiberWrite if the fiber is closed.
+Errors of actual writing close the fiber, and the bundle is notified by FiberClosed.
+*/
+func (fb *Fiber) write(f FiberPacket, prio Priority) error {
+	if fb.IsClosed() {
+		return errFiberWrite
+	}
+
+	select {
+	case err := <-fb.closeSignal:
+		fb.closeSignal <- err
+		return errFiberWrite
+	case fb.writeQueues[validPriority(prio)] <- f:
+		return nil
+	}
+}
+
+/*
+nextQueued takes a queued packet of the highest priority, without waiting.
+*/
+func (fb *Fiber) nextQueued() (FiberPacket, bool) {
+	for _, q := range fb.writeQueues {
+		select {
+		case f := <-q:
+			return f, true
+		default:
+		}
 	}
-	if n < len(packed) || err != nil {
+	return FiberPacket{}, false
+}
+
+/*
+writeRecord writes packets in batch on conn, as one record.
+If the encryptor supports, they are packed in a pooled frame and encrypted in place.
+*/
+func (fb *Fiber) writeRecord(batch []FiberPacket) error {
+	size := recordLen(batch)
+	var n int
+	var err error
+
+	start := time.Now()
+	if fio, ok := fb.encryptor.(FrameIO); ok {
+		head := fio.FrameHead()
+		buf := getBuffer(head + size + fio.FrameTail())
+		fb.packRecord(buf.bytes[head:head+size], batch)
+		if sio, ok := fb.encryptor.(SequencedIO); ok {
+			n, err = sio.WriteFrameAt(fb.conn, buf.bytes, size, fb.position(&fb.writeBuf, fb.isClient(), fb.writeSeq))
+		} else {
+			n, err = fio.WriteFrame(fb.conn, buf.bytes, size)
+		}
+		buf.release()
+	} else {
+		record := make([]byte, size)
+		fb.packRecord(record, batch)
+		n, err = fb.encryptor.WritePacket(fb.conn, record)
+	}
+	fb.writeSeq++
+	fb.updateWriteLatency(time.Since(start))
+	if debugging() {
+		for _, f := range batch {
+			if f.msgType == typeSendData {
+				LogDebug("[Fiber.write]", f.id)
+			}
+		}
+	}
+	if n < size || err != nil {
 		//panic("write error should not happen") //for debug
 		return errFiberWrite
 	}
 
 	atomic.StoreInt64(&fb.lastWrite, time.Now().Unix())
+	if fb.bundle != nil && fb.bundle.rekeyable() {
+		fb.bundle.wrote(n)
+	}
 
 	return nil
 }
 
+func (fb *Fiber) updateWriteLatency(sample time.Duration) {
+	old := atomic.LoadInt64(&fb.writeLatency)
+	atomic.StoreInt64(&fb.writeLatency, old+(int64(sample)-old)/8)
+}
+
+/*
+addInFlight records packets written on this fiber (delta > 0) or no longer waiting on it (delta < 0).
+*/
+func (fb *Fiber) addInFlight(delta int64, bytes int64) {
+	atomic.AddInt64(&fb.inFlight, delta)
+	atomic.AddInt64(&fb.inFlightBytes, delta*bytes)
+}
+
+/*
+InFlight returns number of packets written on this fiber but not confirmed.
+*/
+func (fb *Fiber) InFlight() int64 {
+	return atomic.LoadInt64(&fb.inFlight)
+}
+
+/*
+InFlightBytes returns size of packets written on this fiber but not confirmed.
+*/
+func (fb *Fiber) InFlightBytes() int64 {
+	return atomic.LoadInt64(&fb.inFlightBytes)
+}
+
+/*
+CongestionWindow returns bytes allowed to be in flight on this fiber.
+*/
+func (fb *Fiber) CongestionWindow() int64 {
+	return fb.cc.window()
+}
+
+/*
+congested tells if the congestion window is full.
+A fiber with nothing in flight is never congested, so large packets are still sent.
+*/
+func (fb *Fiber) congested() bool {
+	return fb.InFlight() > 0 && fb.InFlightBytes() >= fb.cc.window()
+}
+
+/*
+throttled tells if the rate limit of this fiber is reached.
+*/
+func (fb *Fiber) throttled() bool {
+	return fb.shaper != nil && fb.shaper.exhausted(time.Now())
+}
+
+/*
+QueueLen returns number of packets waiting to be written on this fiber.
+*/
+func (fb *Fiber) QueueLen() int {
+	n := 0
+	for _, q := range fb.writeQueues {
+		n += len(q)
+	}
+	return n
+}
+
+/*
+RTT returns smoothed round-trip time of this fiber, or 0 if it is not measured yet.
+*/
+func (fb *Fiber) RTT() time.Duration {
+	return fb.rtt.getRTT()
+}
+
+/*
+WriteLatency returns smoothed time spent on writing a packet to this fiber.
+*/
+func (fb *Fiber) WriteLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&fb.writeLatency))
+}
+
 func (fb *Fiber) Close(err error) {
 	if 1 != atomic.AddUint32(&fb.cleaned, 1) {
 		return
@@ -0,0 +1,165 @@
+package bundle
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type brokenConn struct {
+	closed chan empty
+}
+
+func (c *brokenConn) Read(buf []byte) (int, error) {
+	<-c.closed
+	return 0, errors.New("closed")
+}
+
+func (c *brokenConn) Write(buf []byte) (int, error) {
+	return 0, errors.New("broken")
+}
+
+func (c *brokenConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+/*
+readRecord reads one record from conn, and returns packets in it.
+*/
+func readRecord(fb *Fiber, encryptor CryptoIO, conn net.Conn) []*FiberPacket {
+	msg, err := encryptor.ReadPacket(conn)
+	if err != nil {
+		panic("packets are interleaved")
+	}
+	pkt := fb.unpack(msg)
+	if pkt.msgType != typeBatch {
+		return []*FiberPacket{pkt}
+	}
+	pkts, err := fb.unpackBatch(pkt.message)
+	if err != nil {
+		panic("batch error")
+	}
+	return pkts
+}
+
+func TestFiberConcurrentWrite(t *testing.T) {
+	conns := localConnPairs("127.0.0.1:20005", 1)
+	encryptor := NewCedarCryptoIO("12345")
+	fb := NewFiber(conns[0], encryptor, nil)
+
+	writers, count := 10, 200
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := make([]byte, 1000+i)
+			for j := 0; j < count; j++ {
+				if fb.write(FiberPacket{uint32(j + 1), typeSendData, msg}, PriorityBulk) != nil {
+					panic("write should succeed")
+				}
+			}
+		}(i)
+	}
+
+	//every packet must be read intact, none interleaved
+	for i := 0; i < writers*count; {
+		for _, pkt := range readRecord(fb, encryptor, conns[1]) {
+			if pkt.msgType == typeSendData {
+				if len(pkt.message) < 1000 || len(pkt.message) >= 1000+writers {
+					panic("packet length error")
+				}
+				i++
+			}
+		}
+	}
+	wg.Wait()
+
+	fb.Close(nil)
+	conns[1].Close()
+}
+
+func TestFiberWriteError(t *testing.T) {
+	fb := NewFiber(&brokenConn{make(chan empty)}, NewCedarCryptoIO("12345"), nil)
+
+	if fb.write(FiberPacket{1, typeSendData, []byte("x")}, PriorityBulk) != nil {
+		panic("packet should be queued")
+	}
+
+	for i := 0; !fb.IsClosed(); i++ {
+		if i > 100 {
+			panic("fiber should be closed on write error")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if fb.write(FiberPacket{2, typeSendData, []byte("x")}, PriorityBulk) != errFiberWrite {
+		panic("writing on closed fiber should fail")
+	}
+}
+
+func TestFiberWritePriority(t *testing.T) {
+	server, client := net.Pipe()
+	encryptor := NewCedarCryptoIO("12345")
+	fb := NewFiber(server, encryptor, nil)
+
+	//pipe is not read yet, so packets wait in the queues
+	count := 10
+	for i := 0; i < count; i++ {
+		fb.write(FiberPacket{uint32(i + 1), typeSendData, []byte("bulk")}, PriorityBulk)
+	}
+	fb.write(FiberPacket{100, typeSendData, []byte("control")}, PriorityControl)
+
+	//at most one record of bulk packets is taken before control one is queued
+	found := -1
+	for i, n := 0, 0; n < count+1; i++ {
+		for _, pkt := range readRecord(fb, encryptor, client) {
+			if pkt.id == 100 {
+				found = i
+			}
+			n++
+		}
+	}
+	if found < 0 || found > 1 {
+		panic("control packet should be written before bulk ones")
+	}
+
+	fb.Close(nil)
+	client.Close()
+}
+
+/*
+packetOnlyIO hides FrameIO of an encryptor, so packets are copied before encryption.
+*/
+type packetOnlyIO struct {
+	CryptoIO
+}
+
+func benchmarkFiberWrite(b *testing.B, encryptor CryptoIO) {
+	fb := &Fiber{conn: new(replayConn), encryptor: encryptor}
+	pkt := FiberPacket{1, typeSendData, make([]byte, benchmarkMessageLen)}
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkMessageLen)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := fb.writeRecord([]FiberPacket{pkt}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkFiberWriteCopied(b *testing.B) {
+	benchmarkFiberWrite(b, packetOnlyIO{NewCedarCryptoIO("12345")})
+}
+
+func BenchmarkFiberWriteInPlace(b *testing.B) {
+	benchmarkFiberWrite(b, NewCedarCryptoIO("12345"))
+}
@@ -0,0 +1,113 @@
+package bundle
+
+import (
+	"errors"
+)
+
+/*
+ErrMessageTooLarge is returned when sending a message larger than the max size of the bundle.
+*/
+var ErrMessageTooLarge = errors.New("message too large")
+
+/*
+fragmentKey tells which message a fragment is of.
+Fragments of a message are sent in order, without others of the same stream and priority in between.
+*/
+type fragmentKey struct {
+	stream uint32
+	prio   Priority
+}
+
+/*
+reassembly is a message of which some fragments are forwarded.
+*/
+type reassembly struct {
+	data    []byte
+	dropped bool //too large, fragments left are dropped as well
+}
+
+/*
+SetMTU makes messages larger than mtu fragmented, so that they are spread over fibers.
+The other side reassembles them before onReceived.
+*/
+func (bd *FiberBundle) SetMTU(mtu int) {
+	if mtu < 1 {
+		mtu = globalMTU
+	}
+	bd.sendLock.Lock()
+	bd.mtu = mtu
+	bd.sendLock.Unlock()
+}
+
+/*
+SetMaxFrameSize makes messages fragmented to fit frames of size bytes read by this side, no limit if 0.
+Frames read by the other side are limited by its max frame from handshake.
+*/
+func (bd *FiberBundle) SetMaxFrameSize(size int) {
+	bd.sendLock.Lock()
+	bd.maxFrame = size
+	bd.sendLock.Unlock()
+}
+
+/*
+fragmentSize returns MTU, less if frames of either side would be too large. sendLock should be held.
+*/
+func (bd *FiberBundle) fragmentSize() int {
+	mtu := bd.mtu
+	for _, frame := range []int{bd.maxFrame, bd.peerFrame} {
+		if frame > 0 && mtu > frame-globalFrameOverhead {
+			mtu = frame - globalFrameOverhead
+		}
+	}
+	if mtu < globalMinMTU {
+		mtu = globalMinMTU
+	}
+	return mtu
+}
+
+/*
+SetMaxMessageSize sets the max size of messages sent or received, after reassembly.
+Sending larger ones fails with ErrMessageTooLarge, and larger ones received are dropped.
+*/
+func (bd *FiberBundle) SetMaxMessageSize(size int) {
+	if size < 1 {
+		size = globalMaxMessage
+	}
+	bd.sendLock.Lock()
+	bd.maxMessage = size
+	bd.sendLock.Unlock()
+}
+
+/*
+reassemble collects a fragment of message key, and returns the whole message with the last fragment.
+Messages larger than the max size are dropped. receiveLock should be held.
+*/
+func (bd *FiberBundle) reassemble(key fragmentKey, more bool, body []byte) ([]byte, bool) {
+	bd.sendLock.RLock()
+	maxMessage := bd.maxMessage
+	bd.sendLock.RUnlock()
+
+	r, ok := bd.fragments[key]
+	if !ok {
+		if !more {
+			return body, len(body) <= maxMessage
+		}
+		r = new(reassembly)
+		bd.fragments[key] = r
+	}
+
+	if !r.dropped {
+		if len(r.data)+len(body) > maxMessage {
+			LogDebug("[Bundle.reassemble.tooLarge]", key.stream)
+			r.data, r.dropped = nil, true
+		} else {
+			r.data = append(r.data, body...)
+		}
+	}
+	if more {
+		return nil, false
+	}
+
+	delete(bd.fragments, key)
+	return r.data, !r.dropped
+}
@@ -0,0 +1,110 @@
+package bundle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestReassemble(t *testing.T) {
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000}
+	bd := NewFiberBundle(10, "server", &hsr)
+	bd.SetMaxMessageSize(10)
+
+	if _, ok := bd.reassemble(fragmentKey{1, PriorityBulk}, true, []byte("12345")); ok {
+		panic("message should not be complete")
+	}
+	if msg, ok := bd.reassemble(fragmentKey{2, PriorityBulk}, false, []byte("x")); !ok || string(msg) != "x" {
+		panic("other streams should not be affected")
+	}
+	if msg, ok := bd.reassemble(fragmentKey{1, PriorityBulk}, false, []byte("678")); !ok || string(msg) != "12345678" {
+		panic("reassembly error")
+	}
+
+	//too large, dropped as a whole
+	bd.reassemble(fragmentKey{1, PriorityBulk}, true, []byte("12345"))
+	bd.reassemble(fragmentKey{1, PriorityBulk}, true, []byte("12345"))
+	if _, ok := bd.reassemble(fragmentKey{1, PriorityBulk}, false, []byte("1")); ok {
+		panic("large message should be dropped")
+	}
+	if _, ok := bd.reassemble(fragmentKey{1, PriorityBulk}, false, []byte("12345678901")); ok {
+		panic("large message should be dropped")
+	}
+	if msg, ok := bd.reassemble(fragmentKey{1, PriorityBulk}, false, []byte("1")); !ok || string(msg) != "1" {
+		panic("message after dropped one should be received")
+	}
+
+	if bd.SendMessage(make([]byte, 11), PriorityBulk) != ErrMessageTooLarge {
+		panic("large message should not be sent")
+	}
+
+	//MTU fits the smaller max frame of both sides
+	bd.SetMaxFrameSize(globalFrameOverhead + 3000)
+	bd.peerFrame = globalFrameOverhead + 2000
+	if bd.fragmentSize() != 2000 {
+		panic("MTU should fit max frame of the other side")
+	}
+	bd.SetMaxFrameSize(globalFrameOverhead + 1500)
+	if bd.fragmentSize() != 1500 {
+		panic("MTU should fit max frame of this side")
+	}
+	bd.SetMaxFrameSize(1)
+	if bd.fragmentSize() != globalMinMTU {
+		panic("MTU should not be less than the min")
+	}
+
+	bd.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestBundleFragmentation(t *testing.T) {
+	msgCount := 50
+	streams := 2
+	received := make(chan []byte, msgCount*streams)
+
+	conns := localConnPairs("127.0.0.1:20014", 2)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[2]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	bdS := NewFiberBundle(20, "server", &hsrS)
+	bdC := NewFiberBundle(20, "client", &hsrC)
+	bdC.SetMTU(100)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+	for i := 0; i < 2; i++ {
+		NewFiber(conns[i], encryptor, bdS)
+		NewFiber(conns[i+2], encryptor, bdC)
+	}
+
+	//message i of stream s is (s, i) repeated, of length 2 to about 1000
+	message := func(s int, i int) []byte {
+		return bytes.Repeat([]byte{byte(s), byte(i)}, 1+i*i%500)
+	}
+	for s := 0; s < streams; s++ {
+		go func(s int) {
+			for i := 0; i < msgCount; i++ {
+				bdC.SendStreamMessage(uint32(s), message(s, i), Priority(s))
+			}
+		}(s)
+	}
+
+	next := make([]int, streams)
+	for i := 0; i < msgCount*streams; i++ {
+		select {
+		case x := <-received:
+			s := int(x[0])
+			if !bytes.Equal(x, message(s, next[s])) {
+				panic("message error")
+			}
+			next[s]++
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
@@ -2,19 +2,42 @@ package bundle
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/binary"
 	"errors"
 	"io"
 	"sync"
 	"sync/atomic"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
 /*
 Handshaker manages the handshakes.
 It accepts a handshake packet from server's side, and also sends handshake packet from client.
+
+Handshake packets are encrypted by the encryptor, with key from password.
+A new bundle gets a session key by X25519 key exchange, with keys of both sides thrown away afterwards.
+Fibers of the bundle are encrypted with the session key, so that the password would not decrypt them.
+A fiber added to a bundle proves that both sides know the session key.
+
+Keys from password depend on KDF. Nothing of KDF is sent, server tries encryptors of all KDFs accepted
+on a request instead, so that requests look random from the first byte. Old peers use SimpleKDF.
+
+A multi-user server finds the user of a request by its tag, and the request is encrypted by the secret of the user.
+See userTable.
 */
 type Handshaker struct {
-	encryptor CryptoIO
+	encryptor CryptoIO            //of requests
+	accepted  map[string]CryptoIO //of requests accepted, by spec of KDF
+	kdfs      map[string]KDF      //accepted, by spec
+	tagKey    []byte              //of tags of user sent before requests, nil if not sent
+	users     *userTable          //nil if server is not multi-user
+	maxFrame  uint32              //of this side, sent in handshakes
 	bundles   *BundleCollection
 
 	nonceLock    sync.Mutex
@@ -23,10 +46,14 @@ type Handshaker struct {
 }
 
 type HandshakeResult struct {
-	id    uint32
-	idS2C uint32 // ID of next packet from Server/Client to Client/Server.
-	idC2S uint32
-	conn  io.ReadWriteCloser
+	id       uint32
+	idS2C    uint32 // ID of next packet from Server/Client to Client/Server.
+	idC2S    uint32
+	conn     io.ReadWriteCloser
+	key      []byte //session key of the bundle
+	user     string //ID of user of multi-user server, "" if not
+	maxFrame uint32 //of the other side, 0 if unknown
+	nonce    uint64 //of the request, tells fibers apart
 }
 
 const (
@@ -35,13 +62,31 @@ const (
 	addMagic       = "gO_ceDR!"
 	replyMagic     = "AccEPt!!"
 	refuseMagic    = "!fAiLEd!"
+
+	publicKeyLen  = 32 //of X25519
+	proofLen      = sha256.Size
+	sessionKeyLen = 64
 )
 
+/*
+Handshake packets:
+	[applyMagic 8B][nonce 8B][max frame 4B][public key of client 32B]
+	[addMagic   8B][nonce 8B][id 4B][proof 32B]
+	[replyMagic 8B][id 4B][seqS2C 4B][seqC2S 4B][max frame 4B][public key of server 32B]
+	[replyMagic 8B][id 4B][seqS2C 4B][seqC2S 4B][proof 32B]
+Proof is HMAC-SHA256 by the session key, of the packet before it (and nonce of the request, for a reply).
+Max frame of a side is only sent for a new bundle, the other side fragments messages to fit it.
+*/
+
 var ErrHandshakeFailed = errors.New("handshake failed")
 
+/*
+NewHandshaker creates a Handshaker, whose handshakes are encrypted by encryptor with keys from SimpleKDF.
+*/
 func NewHandshaker(encryptor CryptoIO, bundles *BundleCollection) *Handshaker {
 	ret := new(Handshaker)
-	ret.encryptor = encryptor
+	ret.UseKDF(SimpleKDF{}, encryptor)
+	ret.maxFrame = uint32(globalMaxFrame)
 	ret.bundles = bundles
 	ret.nonceArray = make([]uint64, nonceArraySize)
 	ret.nonceCounter = 0
@@ -97,60 +142,286 @@ func NewHandshaker(encryptor CryptoIO, bundles *BundleCollection) *Handshaker {
 	return id, 0, 0, nil
 }*/
 
+/*
+UseKDF makes requests encrypted by encryptor, with keys from kdf. Only requests of it are accepted.
+*/
+func (hs *Handshaker) UseKDF(kdf KDF, encryptor CryptoIO) {
+	hs.encryptor = encryptor
+	hs.accepted = make(map[string]CryptoIO)
+	hs.kdfs = make(map[string]KDF)
+	hs.AcceptKDF(kdf, encryptor)
+}
+
+/*
+AcceptKDF makes requests of kdf also accepted, they are decrypted by encryptor.
+So that peers could migrate from one KDF to another one by one.
+*/
+func (hs *Handshaker) AcceptKDF(kdf KDF, encryptor CryptoIO) {
+	hs.accepted[string(kdf.Spec())] = encryptor
+	hs.kdfs[string(kdf.Spec())] = kdf
+}
+
+/*
+SetUser makes requests sent as user id of a multi-user server, whose secret is password of encryptor from kdf.
+*/
+func (hs *Handshaker) SetUser(id string, secret string, kdf KDF) {
+	hs.tagKey = userKey(kdf, id, secret)
+}
+
+/*
+SetUsers makes server multi-user, with secrets of users by their IDs.
+Requests of a user are decrypted by encryptor from newEncryptor, with its secret as password.
+Requests of no user are refused. It is not multi-user if secrets is nil.
+Keys of users are generated at once for KDFs accepted, so it should be called after them.
+*/
+func (hs *Handshaker) SetUsers(secrets map[string]string, newEncryptor func(password string, kdf KDF) CryptoIO) {
+	if secrets == nil {
+		hs.users = nil
+		return
+	}
+	kdfs := make([]KDF, 0, len(hs.kdfs))
+	for _, kdf := range hs.kdfs {
+		kdfs = append(kdfs, kdf)
+	}
+	hs.users = newUserTable(secrets, kdfs, newEncryptor)
+}
+
+/*
+SetMaxFrameSize sets the max frame of this side, sent in handshakes of new bundles.
+*/
+func (hs *Handshaker) SetMaxFrameSize(size int) {
+	hs.maxFrame = uint32(size)
+}
+
+/*
+writeRequest writes tag of user (if set) and msg encrypted to conn.
+*/
+func (hs *Handshaker) writeRequest(conn io.ReadWriteCloser, msg []byte) error {
+	if hs.tagKey != nil {
+		if _, err := conn.Write(newUserTag(hs.tagKey)); err != nil {
+			return err
+		}
+	}
+	_, err := hs.encryptor.WritePacket(conn, msg)
+	return err
+}
+
+/*
+rewindConn records what is read from conn, so that it could be read again from the start.
+*/
+type rewindConn struct {
+	conn io.ReadWriter
+	read []byte //read from conn
+	pos  int    //of next read, in read
+	err  error  //of conn
+}
+
+func (rc *rewindConn) Read(p []byte) (int, error) {
+	if rc.pos < len(rc.read) {
+		n := copy(p, rc.read[rc.pos:])
+		rc.pos += n
+		return n, nil
+	}
+	n, err := rc.conn.Read(p)
+	rc.read = append(rc.read, p[:n]...)
+	rc.pos += n
+	if err != nil {
+		rc.err = err
+	}
+	return n, err
+}
+
+func (rc *rewindConn) Write(p []byte) (int, error) {
+	return rc.conn.Write(p)
+}
+
+func (rc *rewindConn) rewind() {
+	rc.pos = 0
+}
+
+/*
+readRequest reads a request from conn, trying encryptors of all KDFs accepted on it.
+All of them are of the same cipher, so a wrong one fails on the header, and reads no more than the right one.
+It returns the request, encryptor of it and ID of the user.
+*/
+func (hs *Handshaker) readRequest(conn io.ReadWriteCloser) ([]byte, CryptoIO, string, error) {
+	if hs.users != nil {
+		tag := make([]byte, userTagLen)
+		if _, err := io.ReadFull(conn, tag); err != nil {
+			return nil, nil, "", err
+		}
+		user, encryptor, ok := hs.users.find(tag)
+		if !ok {
+			return nil, nil, "", ErrHandshakeFailed
+		}
+		msg, err := encryptor.ReadPacket(conn)
+		return msg, encryptor, user, err
+	}
+
+	rc := &rewindConn{conn: conn}
+	for _, encryptor := range hs.accepted {
+		rc.rewind()
+		msg, err := encryptor.ReadPacket(rc)
+		if err == nil {
+			return msg, encryptor, "", nil
+		}
+		if rc.err != nil {
+			return nil, nil, "", rc.err
+		}
+	}
+	return nil, nil, "", ErrHandshakeFailed
+}
+
+/*
+newKeyPair generates a X25519 key pair, it returns private key and public key.
+*/
+func newKeyPair() ([]byte, []byte, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
+
+/*
+sessionKey computes the session key from private key of this side and public key of the other.
+*/
+func sessionKey(private []byte, peer []byte, clientPublic []byte, serverPublic []byte) ([]byte, error) {
+	secret, err := curve25519.X25519(private, peer)
+	if err != nil {
+		return nil, ErrHandshakeFailed
+	}
+
+	salt := make([]byte, 0, 2*publicKeyLen)
+	salt = append(append(salt, clientPublic...), serverPublic...)
+	ret := make([]byte, sessionKeyLen)
+	if _, err := io.ReadFull(hkdf.New(sha512.New, secret, salt, []byte("cedar/session")), ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+handshakeProof returns HMAC of parts by key.
+*/
+func handshakeProof(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
 func (hs *Handshaker) RequestNewBundle(conn io.ReadWriteCloser) (HandshakeResult, error) {
+	private, public, err := newKeyPair()
+	if err != nil {
+		return HandshakeResult{}, err
+	}
+
 	//Prepare for message
-	msg := make([]byte, 16)
+	msg := make([]byte, 20+publicKeyLen)
 	nonce := DefaultRNG.Uint64()
 	copy(msg[0:8], applyMagic)
 	binary.BigEndian.PutUint64(msg[8:16], nonce)
+	binary.BigEndian.PutUint32(msg[16:20], hs.maxFrame)
+	copy(msg[20:], public)
 
 	//Ask server for new ID
-	_, err := hs.encryptor.WritePacket(conn, msg)
+	err = hs.writeRequest(conn, msg)
 	if err != nil {
 		return HandshakeResult{}, err
 	}
 
-	return hs.getResponse(conn)
+	ret, extra, err := hs.getResponse(conn, 4+publicKeyLen)
+	if err != nil {
+		return HandshakeResult{}, err
+	}
+	ret.maxFrame = binary.BigEndian.Uint32(extra[0:4])
+	ret.nonce = nonce
+	ret.key, err = sessionKey(private, extra[4:], public, extra[4:])
+	if err != nil {
+		return HandshakeResult{}, err
+	}
+	return ret, nil
 }
 
 func (hs *Handshaker) RequestAddToBundle(conn io.ReadWriteCloser, id uint32) (HandshakeResult, error) {
+	bd := hs.bundles.GetBundle(id)
+	if bd == nil {
+		return HandshakeResult{}, ErrHandshakeFailed
+	}
+
 	//Prepare for message
-	msg := make([]byte, 20)
+	msg := make([]byte, 20+proofLen)
 	nonce := DefaultRNG.Uint64()
 	copy(msg[0:8], addMagic)
 	binary.BigEndian.PutUint64(msg[8:16], nonce)
 	binary.BigEndian.PutUint32(msg[16:20], id)
+	copy(msg[20:], handshakeProof(bd.sessionKey, msg[0:20]))
 
 	//Ask server for new ID
-	_, err := hs.encryptor.WritePacket(conn, msg)
+	err := hs.writeRequest(conn, msg)
 	if err != nil {
 		return HandshakeResult{}, err
 	}
 
-	return hs.getResponse(conn)
+	ret, extra, err := hs.getResponse(conn, proofLen)
+	if err != nil {
+		return HandshakeResult{}, err
+	}
+	if ret.id != id || !hmac.Equal(extra, handshakeProof(bd.sessionKey, ret.reply(), msg[8:16])) {
+		return HandshakeResult{}, ErrHandshakeFailed
+	}
+	ret.key = bd.sessionKey
+	ret.nonce = nonce
+	return ret, nil
 }
-func (hs *Handshaker) createNewBundle(conn io.ReadWriteCloser) (HandshakeResult, error) {
+
+/*
+reply returns the reply of handshake, without the extra part.
+*/
+func (hsr *HandshakeResult) reply() []byte {
+	msg := make([]byte, 20)
+	copy(msg[0:8], []byte(replyMagic))
+	binary.BigEndian.PutUint32(msg[8:12], hsr.id)
+	binary.BigEndian.PutUint32(msg[12:16], hsr.idS2C)
+	binary.BigEndian.PutUint32(msg[16:20], hsr.idC2S)
+	return msg
+}
+
+func (hs *Handshaker) createNewBundle(conn io.ReadWriteCloser, encryptor CryptoIO, user string, request []byte) (HandshakeResult, error) {
+	clientPublic := request[20:]
+	private, public, err := newKeyPair()
+	if err != nil {
+		return HandshakeResult{}, err
+	}
+	key, err := sessionKey(private, clientPublic, clientPublic, public)
+	if err != nil {
+		return HandshakeResult{}, err
+	}
+
 	id := uint32(0)
 	for id == 0 || hs.bundles.HasID(id) {
 		id = DefaultRNG.Uint32()
 	}
-
-	msg := make([]byte, 20)
 	seqC2s := DefaultRNG.Uint32()
 	seqS2c := DefaultRNG.Uint32()
+	ret := HandshakeResult{id, seqS2c, seqC2s, conn, key, user, binary.BigEndian.Uint32(request[16:20]), binary.BigEndian.Uint64(request[8:16])}
 
-	copy(msg[0:8], []byte(replyMagic))
-	binary.BigEndian.PutUint32(msg[8:12], id)
-	binary.BigEndian.PutUint32(msg[12:16], seqS2c)
-	binary.BigEndian.PutUint32(msg[16:20], seqC2s)
-
-	_, err := hs.encryptor.WritePacket(conn, msg)
+	msg := make([]byte, 4, 4+publicKeyLen)
+	binary.BigEndian.PutUint32(msg, hs.maxFrame)
+	msg = append(append(ret.reply(), msg...), public...)
+	_, err = encryptor.WritePacket(conn, msg)
 	if err != nil {
 		return HandshakeResult{}, err
 	}
 
-	LogDebug("createNewBundle success!", conn, id, seqS2c, seqC2s)
-	return HandshakeResult{id, seqS2c, seqC2s, conn}, nil
+	LogDebug("createNewBundle success!", conn, id, seqS2c, seqC2s, user)
+	return ret, nil
 }
 
 func (hs *Handshaker) addNonce(nonce uint64) bool {
@@ -174,31 +445,32 @@ func (hs *Handshaker) addNonce(nonce uint64) bool {
 	return true
 }
 
-func (hs *Handshaker) addBundle(conn io.ReadWriteCloser, id uint32) (HandshakeResult, error) {
-	if !hs.bundles.HasID(id) {
+func (hs *Handshaker) addBundle(conn io.ReadWriteCloser, encryptor CryptoIO, user string, request []byte) (HandshakeResult, error) {
+	id := binary.BigEndian.Uint32(request[16:20])
+	bd := hs.bundles.GetBundle(id)
+	if bd == nil || bd.user != user {
+		return HandshakeResult{}, ErrHandshakeFailed
+	}
+	if !hmac.Equal(request[20:], handshakeProof(bd.sessionKey, request[0:20])) {
 		return HandshakeResult{}, ErrHandshakeFailed
 	}
 
-	msg := make([]byte, 20)
-	bd := hs.bundles.GetBundle(id)
-
-	copy(msg[0:8], []byte(replyMagic))
 	c2s := atomic.LoadUint32(&bd.seqs[download])
 	s2c := atomic.LoadUint32(&bd.seqs[upload])
-	binary.BigEndian.PutUint32(msg[8:12], id)
-	binary.BigEndian.PutUint32(msg[12:16], s2c)
-	binary.BigEndian.PutUint32(msg[16:20], c2s)
+	ret := HandshakeResult{id, s2c, c2s, conn, bd.sessionKey, user, 0, binary.BigEndian.Uint64(request[8:16])}
 
-	_, err := hs.encryptor.WritePacket(conn, msg)
+	reply := ret.reply()
+	msg := append(reply, handshakeProof(bd.sessionKey, reply, request[8:16])...)
+	_, err := encryptor.WritePacket(conn, msg)
 	if err != nil {
 		return HandshakeResult{}, err
 	}
 
-	return HandshakeResult{id, s2c, c2s, conn}, nil
+	return ret, nil
 }
 
 func (hs *Handshaker) ConfirmHandshake(conn io.ReadWriteCloser) (HandshakeResult, error) {
-	msg, err := hs.encryptor.ReadPacket(conn)
+	msg, encryptor, user, err := hs.readRequest(conn)
 	if err != nil {
 		return HandshakeResult{}, err
 	}
@@ -210,22 +482,24 @@ func (hs *Handshaker) ConfirmHandshake(conn io.ReadWriteCloser) (HandshakeResult
 		}
 	}
 
-	if len(msg) == 16 && bytes.Equal(msg[0:8], []byte(applyMagic)) {
-		return hs.createNewBundle(conn)
+	if len(msg) == 20+publicKeyLen && bytes.Equal(msg[0:8], []byte(applyMagic)) {
+		return hs.createNewBundle(conn, encryptor, user, msg)
 	}
-	if len(msg) == 20 && bytes.Equal(msg[0:8], []byte(addMagic)) {
-		id := binary.BigEndian.Uint32(msg[16:20])
-		return hs.addBundle(conn, id)
+	if len(msg) == 20+proofLen && bytes.Equal(msg[0:8], []byte(addMagic)) {
+		return hs.addBundle(conn, encryptor, user, msg)
 	}
 
 	return HandshakeResult{}, ErrHandshakeFailed
 }
 
-func (hs *Handshaker) getResponse(conn io.ReadWriteCloser) (HandshakeResult, error) {
+/*
+getResponse reads the reply of handshake. The extra part (public key or proof) of extraLen bytes is returned.
+*/
+func (hs *Handshaker) getResponse(conn io.ReadWriteCloser, extraLen int) (HandshakeResult, []byte, error) {
 	msg, err := hs.encryptor.ReadPacket(conn)
 
-	if err != nil || len(msg) != 20 || !bytes.Equal(msg[0:8], []byte(replyMagic)) {
-		return HandshakeResult{}, ErrHandshakeFailed
+	if err != nil || len(msg) != 20+extraLen || !bytes.Equal(msg[0:8], []byte(replyMagic)) {
+		return HandshakeResult{}, nil, ErrHandshakeFailed
 	}
 
 	ret := HandshakeResult{}
@@ -234,6 +508,6 @@ func (hs *Handshaker) getResponse(conn io.ReadWriteCloser) (HandshakeResult, err
 	ret.idC2S = binary.BigEndian.Uint32(msg[16:20])
 	ret.conn = conn
 
-	LogDebug("getResponse success!", ret)
-	return ret, nil
+	LogDebug("getResponse success!", ret.id, ret.idS2C, ret.idC2S)
+	return ret, msg[20:], nil
 }
@@ -1,33 +1,192 @@
 package bundle
 
 import (
+	"bytes"
 	"testing"
 )
 
 func TestHandshakeBasic(t *testing.T) {
-	conns := localConnPairs("127.0.0.1:20003", 2)
+	conns := localConnPairs("127.0.0.1:20003", 3)
 
 	encryptor := NewCedarCryptoIO("12345")
 
 	bdc := NewBundleCollection()
 	handshaker := NewHandshaker(encryptor, bdc)
+	handshaker.SetMaxFrameSize(20000)
 
-	go handshaker.ConfirmHandshake(conns[0])
-	hsr, err := handshaker.RequestNewBundle(conns[2])
+	confirmed := make(chan HandshakeResult, 1)
+	confirm := func(i int) {
+		hsr, err := handshaker.ConfirmHandshake(conns[i])
+		if err != nil {
+			conns[i].Close()
+		}
+		confirmed <- hsr
+	}
+
+	go confirm(0)
+	hsr, err := handshaker.RequestNewBundle(conns[3])
 
 	LogDebug("ID:", hsr.id)
 	if err != nil {
 		panic("RequestNewBundle failed")
 	}
+	hsrS := <-confirmed
+	if hsrS.id != hsr.id || len(hsr.key) != sessionKeyLen || !bytes.Equal(hsr.key, hsrS.key) {
+		panic("both sides should get the same session key")
+	}
+	if hsr.maxFrame != 20000 || hsrS.maxFrame != 20000 {
+		panic("max frame should be sent to the other side")
+	}
+	if hsr.nonce == 0 || hsr.nonce != hsrS.nonce {
+		panic("both sides should get the same stream")
+	}
 
-	bdc.AddBundle(NewFiberBundle(50, "server", &hsr))
+	bdc.AddBundle(NewFiberBundle(50, "server", &hsrS))
 
-	go handshaker.ConfirmHandshake(conns[1])
-	hsr2, err := handshaker.RequestAddToBundle(conns[3], hsr.id)
+	go confirm(1)
+	hsr2, err := handshaker.RequestAddToBundle(conns[4], hsr.id)
 	if err != nil {
 		panic("RequestAddToBundle failed")
 	}
 	if hsr2.id != hsr.id || hsr2.idC2S != hsr.idC2S || hsr2.idS2C != hsr.idS2C {
 		panic("hsr should be equal to hsr2 (id, seqs2c, seqc2s)")
 	}
+	hsrS2 := <-confirmed
+	if !bytes.Equal(hsr2.key, hsr.key) || hsrS2.id != hsr.id {
+		panic("fiber added should use session key of the bundle")
+	}
+	if hsr2.nonce != hsrS2.nonce || hsr2.nonce == hsr.nonce {
+		panic("fiber added should be another stream")
+	}
+
+	//without the session key, no fiber is added
+	client := NewBundleCollection()
+	client.AddBundle(NewFiberBundle(50, "client", &HandshakeResult{id: hsr.id, key: make([]byte, sessionKeyLen)}))
+	go confirm(2)
+	if _, err := NewHandshaker(encryptor, client).RequestAddToBundle(conns[5], hsr.id); err == nil {
+		panic("adding fiber without session key should fail")
+	}
+	if (<-confirmed).id != 0 {
+		panic("server should refuse fiber without session key")
+	}
+}
+
+func TestSessionEncryptor(t *testing.T) {
+	key := make([]byte, sessionKeyLen)
+	DefaultRNG.Read(key)
+
+	for _, base := range []CryptoIO{NewCedarCryptoIO("12345"), NewAESGCMCryptoIO("12345"), NewChaCha20Poly1305CryptoIO("12345")} {
+		session := base.Derive(key)
+		frw := bytes.NewBuffer(nil)
+		session.WritePacket(frw, []byte("hello"))
+		if msg, err := base.Derive(key).ReadPacket(frw); err != nil || string(msg) != "hello" {
+			panic("same session key should decrypt")
+		}
+
+		//the password does not decrypt traffic of a session
+		session.WritePacket(frw, []byte("hello"))
+		if _, err := base.ReadPacket(frw); err == nil {
+			panic("password should not decrypt session")
+		}
+	}
+}
+
+func TestHandshakeKDF(t *testing.T) {
+	conns := localConnPairs("127.0.0.1:20017", 3)
+
+	argon := NewArgon2idKDF(1, 1024, 1, []byte("salt"))
+	newEncryptor := func(kdf KDF) CryptoIO {
+		ret, _ := NewCryptoIOWithKDF(CipherAESGCM, "12345", kdf)
+		return ret
+	}
+
+	//server migrating from SimpleKDF
+	server := NewHandshaker(newEncryptor(SimpleKDF{}), NewBundleCollection())
+	server.UseKDF(argon, newEncryptor(argon))
+	server.AcceptKDF(SimpleKDF{}, newEncryptor(SimpleKDF{}))
+
+	oldClient := NewHandshaker(newEncryptor(SimpleKDF{}), NewBundleCollection())
+	newClient := NewHandshaker(newEncryptor(SimpleKDF{}), NewBundleCollection())
+	newClient.UseKDF(argon, newEncryptor(argon))
+	otherClient := NewHandshaker(newEncryptor(SimpleKDF{}), NewBundleCollection())
+	scrypt := NewScryptKDF(10, 8, 1, []byte("salt"))
+	otherClient.UseKDF(scrypt, newEncryptor(scrypt))
+
+	for i, client := range []*Handshaker{oldClient, newClient, otherClient} {
+		confirmed := make(chan error, 1)
+		go func() {
+			_, err := server.ConfirmHandshake(conns[i])
+			if err != nil {
+				conns[i].Close()
+			}
+			confirmed <- err
+		}()
+		_, err := client.RequestNewBundle(conns[3+i])
+		if (err == nil) != (client != otherClient) || (<-confirmed == nil) != (client != otherClient) {
+			panic("only requests of KDF accepted should succeed")
+		}
+	}
+}
+
+func TestHandshakeUsers(t *testing.T) {
+	conns := localConnPairs("127.0.0.1:20018", 5)
+
+	argon := NewArgon2idKDF(1, 1024, 1, []byte("salt"))
+	newEncryptor := func(password string, kdf KDF) CryptoIO {
+		ret, _ := NewCryptoIOWithKDF(CipherAESGCM, password, kdf)
+		return ret
+	}
+	newClient := func(id string, secret string, kdf KDF) *Handshaker {
+		ret := NewHandshaker(newEncryptor(secret, SimpleKDF{}), NewBundleCollection())
+		ret.UseKDF(kdf, newEncryptor(secret, kdf))
+		if id != "" {
+			ret.SetUser(id, secret, kdf)
+		}
+		return ret
+	}
+
+	bundles := NewBundleCollection()
+	server := NewHandshaker(newEncryptor("unused", SimpleKDF{}), bundles)
+	server.AcceptKDF(argon, newEncryptor("unused", argon))
+	server.SetUsers(map[string]string{"alice": "secret of alice", "bob": "secret of bob"}, newEncryptor)
+
+	clients := []*Handshaker{
+		newClient("alice", "secret of alice", SimpleKDF{}),
+		newClient("bob", "secret of bob", argon),
+		newClient("carol", "secret of alice", SimpleKDF{}),
+		newClient("", "secret of alice", SimpleKDF{}),
+	}
+	users := []string{"alice", "bob", "", ""}
+
+	results := make([]HandshakeResult, len(clients))
+	for i, client := range clients {
+		confirmed := make(chan HandshakeResult, 1)
+		go func() {
+			hsr, err := server.ConfirmHandshake(conns[i])
+			if err != nil {
+				conns[i].Close()
+			}
+			confirmed <- hsr
+		}()
+		_, err := client.RequestNewBundle(conns[5+i])
+		got := <-confirmed
+		if (err == nil) != (users[i] != "") || got.user != users[i] {
+			panic("only requests of users should succeed, with their IDs")
+		}
+		results[i] = got
+	}
+
+	//bob could not add a fiber to bundle of alice, even with its session key
+	bundles.AddBundle(NewFiberBundle(50, "server", &results[0]))
+	clients[1].bundles.AddBundle(NewFiberBundle(50, "client", &HandshakeResult{id: results[0].id, key: results[0].key}))
+	go func() {
+		_, err := server.ConfirmHandshake(conns[4])
+		if err == nil {
+			panic("fiber of another user should be refused")
+		}
+		conns[4].Close()
+	}()
+	if _, err := clients[1].RequestAddToBundle(conns[9], results[0].id); err == nil {
+		panic("fiber of another user should be refused")
+	}
 }
@@ -2,29 +2,96 @@ package bundle
 
 import (
 	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
 )
 
 /*
 KDF is an interface for key derivation function.
 Number of iterations is fixed.
+Spec returns identifier, parameters and salt of the KDF, which tell KDFs accepted apart.
+Both sides get the same keys from the same password only if specs are the same.
 */
 type KDF interface {
 	Generate(password string, salt string, bit int) []byte
+	Spec() []byte
+}
+
+/*
+Identifiers of KDF, the first byte of a spec.
+*/
+const (
+	kdfSimple = uint8(1 + iota)
+	kdfArgon2id
+	kdfScrypt
+)
+
+/*
+Names of KDF, used to select one.
+*/
+const (
+	KDFSimple   = "simple"
+	KDFArgon2id = "argon2id"
+	KDFScrypt   = "scrypt"
+)
+
+/*
+ErrUnknownKDF is returned when a KDF is not supported.
+*/
+var ErrUnknownKDF = errors.New("unknown kdf")
+
+/*
+ErrNoKDFSalt is returned when a KDF needs salt, but it is empty.
+*/
+var ErrNoKDFSalt = errors.New("salt of kdf is empty")
+
+/*
+NewKDF returns KDF of name, with the default parameters and salt.
+Salt should be random for each deployment, and the same on server and clients.
+SimpleKDF does not use it.
+*/
+func NewKDF(name string, salt string) (KDF, error) {
+	switch name {
+	case KDFSimple:
+		return SimpleKDF{}, nil
+	case KDFArgon2id, KDFScrypt:
+		if salt == "" {
+			return nil, ErrNoKDFSalt
+		}
+	default:
+		return nil, ErrUnknownKDF
+	}
+	if name == KDFArgon2id {
+		return NewArgon2idKDF(3, 64*1024, 4, []byte(salt)), nil
+	}
+	return NewScryptKDF(15, 8, 1, []byte(salt)), nil
 }
 
 /*
 SimpleKDF is a simple and casual KDF.
+It is kept for old peers, use Argon2idKDF or ScryptKDF instead.
 */
 type SimpleKDF struct {
 }
 
+/*
+Spec returns spec of SimpleKDF, which has no parameters.
+*/
+func (SimpleKDF) Spec() []byte {
+	return []byte{kdfSimple}
+}
+
 /*
 Generate accepts password, salt, and number of bits (must be not larger than 512 and divided by 8) and returns a key.
 */
 func (SimpleKDF) Generate(password string, salt string, bit int) []byte {
-	// TODO:	Design of this function is quite casual.
-	//			Implement some standards and replace it in the future.
-
+	//Design of this function is quite casual, it is kept for old peers.
 	if bit%8 != 0 {
 		panic("bit length must be integer multiple of 8")
 	}
@@ -51,3 +118,101 @@ func (SimpleKDF) Generate(password string, salt string, bit int) []byte {
 
 	return ret
 }
+
+/*
+stretchedKDF stretches password into a master key by a slow function, then derives keys from it by HKDF.
+Salt of Generate is used as info of HKDF, so keys for different usages are irrelevant.
+Master key of the last password is cached, because the function is slow on purpose.
+*/
+type stretchedKDF struct {
+	spec    []byte
+	stretch func(password []byte) []byte
+
+	lock     sync.Mutex
+	password string
+	master   []byte
+}
+
+/*
+Generate accepts password, salt, and number of bits (must be not larger than 512 and divided by 8) and returns a key.
+*/
+func (k *stretchedKDF) Generate(password string, salt string, bit int) []byte {
+	if bit%8 != 0 {
+		panic("bit length must be integer multiple of 8")
+	}
+	if bit > 512 || bit <= 0 {
+		panic("bit should be > 0 and <= 512")
+	}
+
+	k.lock.Lock()
+	if k.master == nil || k.password != password {
+		k.password = password
+		k.master = k.stretch([]byte(password))
+	}
+	master := k.master
+	k.lock.Unlock()
+
+	return expandKey(master, salt, bit)
+}
+
+/*
+Spec returns identifier, parameters and salt of the KDF.
+*/
+func (k *stretchedKDF) Spec() []byte {
+	return k.spec
+}
+
+/*
+NewArgon2idKDF returns KDF stretching password by Argon2id, with time (passes), memory (in KB), threads and salt.
+Salt should be random for each deployment, so that a dictionary precomputed is useless for others.
+Spec: [kdfArgon2id 1B][time 4B][memory 4B][threads 1B][salt xB]
+*/
+func NewArgon2idKDF(time uint32, memory uint32, threads uint8, salt []byte) KDF {
+	spec := make([]byte, 10, 10+len(salt))
+	spec[0] = kdfArgon2id
+	binary.BigEndian.PutUint32(spec[1:5], time)
+	binary.BigEndian.PutUint32(spec[5:9], memory)
+	spec[9] = threads
+	spec = append(spec, salt...)
+	salt = spec[10:]
+
+	stretch := func(password []byte) []byte {
+		return argon2.IDKey(password, salt, time, memory, threads, 64)
+	}
+	return &stretchedKDF{spec: spec, stretch: stretch}
+}
+
+/*
+NewScryptKDF returns KDF stretching password by scrypt, with N = 2^logN, r, p and salt.
+Salt should be random for each deployment, as of NewArgon2idKDF.
+Spec: [kdfScrypt 1B][logN 1B][r 4B][p 4B][salt xB]
+*/
+func NewScryptKDF(logN uint8, r uint32, p uint32, salt []byte) KDF {
+	spec := make([]byte, 10, 10+len(salt))
+	spec[0] = kdfScrypt
+	spec[1] = logN
+	binary.BigEndian.PutUint32(spec[2:6], r)
+	binary.BigEndian.PutUint32(spec[6:10], p)
+	spec = append(spec, salt...)
+	salt = spec[10:]
+
+	stretch := func(password []byte) []byte {
+		key, err := scrypt.Key(password, salt, 1<<logN, int(r), int(p), 64)
+		if err != nil {
+			panic("illegal parameters of scrypt: " + err.Error())
+		}
+		return key
+	}
+	return &stretchedKDF{spec: spec, stretch: stretch}
+}
+
+/*
+expandKey derives a key of bit bits for info from key, which is already strong (like a session key), by HKDF-SHA512.
+*/
+func expandKey(key []byte, info string, bit int) []byte {
+	ret := make([]byte, bit/8)
+	if _, err := io.ReadFull(hkdf.Expand(sha512.New, key, []byte(info)), ret); err != nil {
+		panic("cannot expand key: " + err.Error())
+	}
+	return ret
+}
@@ -1,6 +1,7 @@
 package bundle
 
 import (
+	"bytes"
 	"encoding/hex"
 	"testing"
 )
@@ -18,3 +19,35 @@ func TestCedarKDF(t *testing.T) {
 		panic("KDF did not get expected result")
 	}
 }
+
+func TestStretchedKDF(t *testing.T) {
+	kdfs := []KDF{NewArgon2idKDF(1, 1024, 1, []byte("salt")), NewScryptKDF(10, 8, 1, []byte("salt"))}
+	for _, k := range kdfs {
+		key := k.Generate("MyPassword", "cedar/msgKey", 256)
+		if len(key) != 32 || !bytes.Equal(key, k.Generate("MyPassword", "cedar/msgKey", 256)) {
+			panic("KDF should be deterministic")
+		}
+		if bytes.Equal(key, k.Generate("MyPassword", "cedar/ivKey", 256)) {
+			panic("keys of different usages should be different")
+		}
+		if bytes.Equal(key, k.Generate("MyPassword2", "cedar/msgKey", 256)) {
+			panic("keys of different passwords should be different")
+		}
+	}
+
+	if bytes.Equal(kdfs[0].Spec(), NewArgon2idKDF(2, 1024, 1, []byte("salt")).Spec()) || bytes.Equal(kdfs[0].Spec(), kdfs[1].Spec()) {
+		panic("parameters should be in spec")
+	}
+	if bytes.Equal(kdfs[0].Generate("MyPassword", "x", 256), NewArgon2idKDF(2, 1024, 1, []byte("salt")).Generate("MyPassword", "x", 256)) {
+		panic("keys of different parameters should be different")
+	}
+	if bytes.Equal(kdfs[0].Generate("MyPassword", "x", 256), NewArgon2idKDF(1, 1024, 1, []byte("pepper")).Generate("MyPassword", "x", 256)) {
+		panic("keys of different salts should be different")
+	}
+	if _, err := NewKDF("md5", "salt"); err != ErrUnknownKDF {
+		panic("unknown KDF should be refused")
+	}
+	if _, err := NewKDF(KDFArgon2id, ""); err != ErrNoKDFSalt {
+		panic("KDF without salt should be refused")
+	}
+}
@@ -0,0 +1,24 @@
+package bundle
+
+/*
+Priority is the class of a message. Higher classes are sent first,
+messages of the same class are sent in order.
+*/
+type Priority int
+
+const (
+	PriorityControl     Priority = iota //acknowledgements, heartbeats and control messages of applications
+	PriorityInteractive                 //latency sensitive traffic
+	PriorityBulk                        //everything else, it cannot take all the window
+	numPriorities
+)
+
+/*
+validPriority returns prio, or PriorityBulk if prio is not a known class.
+*/
+func validPriority(prio Priority) Priority {
+	if prio < PriorityControl || prio >= numPriorities {
+		return PriorityBulk
+	}
+	return prio
+}
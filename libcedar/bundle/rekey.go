@@ -0,0 +1,230 @@
+package bundle
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errStaleEpoch = errors.New("keys of epoch are gone")
+var errFarEpoch = errors.New("epoch is too far ahead")
+
+/*
+Session keys of a bundle are rotated after some bytes or time. Each rotation starts a new epoch.
+Each direction has its own epochs and keys:
+
+	key(0) = session key from handshake
+	key(n) = HKDF-Expand(key(n-1), "cedar/rekey/c2s") (or "cedar/rekey/s2c")
+
+Epoch of writing of a bundle only goes up. Before writing, a fiber behind it writes a packet of typeRekey,
+with id = the new epoch, by the old keys, then switches to the new keys.
+An epoch is at most globalRekeyMaxStep ahead of the latest derived in its direction, larger steps from the other side
+are refused, so that it could not make keys of any number of epochs derived.
+The other side switches keys of reading on that fiber, when the packet is read.
+Each fiber is ordered, so no packet in flight is dropped. Keys of epochs no fiber is on are thrown away.
+
+A new fiber starts from epoch 0, and jumps to the current epoch by its first packet.
+So keys of epoch 0, and the session key (which proves fibers added), are kept as long as the bundle.
+Rotation limits bytes under each key, but gives no erasure of keys: whoever gets the bundle gets all keys.
+*/
+type rekeyState struct {
+	lock     sync.Mutex
+	bytes    int64 //rotate after bytes written, never if 0. Fields till since are atomic
+	interval int64 //rotate after this (in nanoseconds), never if 0
+
+	epoch   uint32 //of writing
+	written int64  //bytes written in the epoch
+	since   int64  //start of the epoch, in unix nanoseconds
+
+	chains [2]keyChain //of upload and download
+}
+
+type keyChain struct {
+	key        []byte //of epoch, the latest derived
+	epoch      uint32
+	encryptors map[uint32]CryptoIO //of epochs > 0
+}
+
+/*
+chainLabel returns label for deriving keys of direction dir.
+*/
+func (bd *FiberBundle) chainLabel(dir int) string {
+	if (bd.bundleType == serverBundle) == (dir == upload) {
+		return "cedar/rekey/s2c"
+	}
+	return "cedar/rekey/c2s"
+}
+
+/*
+SetRekeying makes session keys rotated after bytes written by all fibers, or interval passed.
+0 means never for either of them. It works only for bundles with session keys from handshake.
+*/
+func (bd *FiberBundle) SetRekeying(bytes int64, interval time.Duration) {
+	rk := &bd.rekey
+	atomic.StoreInt64(&rk.bytes, bytes)
+	atomic.StoreInt64(&rk.interval, int64(interval))
+	atomic.StoreInt64(&rk.since, time.Now().UnixNano())
+}
+
+func (bd *FiberBundle) rekeyable() bool {
+	return bd.sessionKey != nil && bd.encryptor != nil
+}
+
+func (bd *FiberBundle) writeEpoch() uint32 {
+	return atomic.LoadUint32(&bd.rekey.epoch)
+}
+
+/*
+wrote counts n bytes written by a fiber, and starts a new epoch if it is time to.
+*/
+func (bd *FiberBundle) wrote(n int) {
+	rk := &bd.rekey
+	atomic.AddInt64(&rk.written, int64(n))
+	if !rk.due() {
+		return
+	}
+
+	rk.lock.Lock()
+	defer rk.lock.Unlock()
+	//other fibers might have started it
+	if rk.due() {
+		atomic.StoreInt64(&rk.written, 0)
+		atomic.StoreInt64(&rk.since, time.Now().UnixNano())
+		atomic.AddUint32(&rk.epoch, 1)
+	}
+}
+
+func (rk *rekeyState) due() bool {
+	bytes := atomic.LoadInt64(&rk.bytes)
+	interval := atomic.LoadInt64(&rk.interval)
+	if bytes > 0 && atomic.LoadInt64(&rk.written) >= bytes {
+		return true
+	}
+	return interval > 0 && time.Now().UnixNano()-atomic.LoadInt64(&rk.since) >= interval
+}
+
+/*
+epochEncryptor returns CryptoIO of epoch in direction dir.
+It fails if keys of the epoch are thrown away, or it is more than globalRekeyMaxStep ahead of the latest derived.
+*/
+func (bd *FiberBundle) epochEncryptor(dir int, epoch uint32) (CryptoIO, error) {
+	if epoch == 0 {
+		return bd.encryptor, nil
+	}
+
+	rk := &bd.rekey
+	rk.lock.Lock()
+	defer rk.lock.Unlock()
+
+	kc := &rk.chains[dir]
+	if kc.key == nil {
+		kc.key = bd.sessionKey
+		kc.encryptors = make(map[uint32]CryptoIO)
+	}
+	if epoch > kc.epoch && epoch-kc.epoch > globalRekeyMaxStep {
+		return nil, errFarEpoch
+	}
+	for kc.epoch < epoch {
+		kc.key = expandKey(kc.key, bd.chainLabel(dir), 8*sessionKeyLen)
+		kc.epoch++
+		kc.encryptors[kc.epoch] = bd.encryptor.Derive(kc.key)
+	}
+	if enc, ok := kc.encryptors[epoch]; ok {
+		return enc, nil
+	}
+	return nil, errStaleEpoch
+}
+
+/*
+latestEpoch returns the latest epoch derived in direction dir.
+*/
+func (bd *FiberBundle) latestEpoch(dir int) uint32 {
+	rk := &bd.rekey
+	rk.lock.Lock()
+	defer rk.lock.Unlock()
+	return rk.chains[dir].epoch
+}
+
+/*
+pruneEpochs throws keys of epochs in direction dir no fiber is on away.
+*/
+func (bd *FiberBundle) pruneEpochs(dir int) {
+	oldest := ^uint32(0)
+	if dir == upload {
+		oldest = bd.writeEpoch()
+	}
+	bd.fibersLock.RLock()
+	for _, fb := range bd.fibers {
+		e := atomic.LoadUint32(&fb.writeEpoch)
+		if dir == download {
+			e = atomic.LoadUint32(&fb.readEpoch)
+		}
+		if e < oldest {
+			oldest = e
+		}
+	}
+	bd.fibersLock.RUnlock()
+
+	rk := &bd.rekey
+	rk.lock.Lock()
+	for e := range rk.chains[dir].encryptors {
+		if e < oldest {
+			delete(rk.chains[dir].encryptors, e)
+		}
+	}
+	rk.lock.Unlock()
+}
+
+/*
+rekeyWrite switches keys of writing to the epoch of bundle, if fb is behind it.
+A new fiber jumps to it at once, as long as it is not too far ahead of the latest derived.
+*/
+func (fb *Fiber) rekeyWrite() error {
+	if fb.bundle == nil || !fb.bundle.rekeyable() {
+		return nil
+	}
+	epoch := fb.bundle.writeEpoch()
+	if epoch == fb.writeEpoch {
+		return nil
+	}
+	if latest := fb.bundle.latestEpoch(upload); epoch > latest && epoch-latest > globalRekeyMaxStep {
+		epoch = latest + globalRekeyMaxStep
+	}
+
+	enc, err := fb.bundle.epochEncryptor(upload, epoch)
+	if err != nil {
+		return err
+	}
+	//the last packet by old keys
+	err = fb.writeRecord([]FiberPacket{{epoch, typeRekey, nil}})
+	if err != nil {
+		return err
+	}
+	fb.encryptor = enc
+	atomic.StoreUint32(&fb.writeEpoch, epoch)
+	fb.bundle.pruneEpochs(upload)
+
+	LogDebug("[Fiber.rekeyWrite]", epoch)
+	return nil
+}
+
+/*
+rekeyRead switches keys of reading to epoch, after a packet of typeRekey is read.
+*/
+func (fb *Fiber) rekeyRead(epoch uint32) error {
+	if fb.bundle == nil || !fb.bundle.rekeyable() || epoch <= fb.readEpoch {
+		return errFiberRead
+	}
+
+	dec, err := fb.bundle.epochEncryptor(download, epoch)
+	if err != nil {
+		return err
+	}
+	fb.decryptor = dec
+	atomic.StoreUint32(&fb.readEpoch, epoch)
+	fb.bundle.pruneEpochs(download)
+
+	LogDebug("[Fiber.rekeyRead]", epoch)
+	return nil
+}
@@ -0,0 +1,157 @@
+package bundle
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRekeyDue(t *testing.T) {
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, key: make([]byte, sessionKeyLen)}
+	bd := NewFiberBundle(10, "client", &hsr)
+
+	bd.SetRekeying(100, 0)
+	bd.wrote(99)
+	if bd.writeEpoch() != 0 {
+		panic("keys should not be rotated yet")
+	}
+	bd.wrote(1)
+	if bd.writeEpoch() != 1 {
+		panic("keys should be rotated after bytes written")
+	}
+
+	bd.SetRekeying(0, 10*time.Millisecond)
+	bd.wrote(1000)
+	time.Sleep(20 * time.Millisecond)
+	bd.wrote(1)
+	if bd.writeEpoch() != 2 {
+		panic("keys should be rotated after interval")
+	}
+
+	bd.encryptor = NewAESGCMCryptoIO("12345").Derive(hsr.key)
+	fb := &Fiber{bundle: bd}
+	if fb.rekeyRead(globalRekeyMaxStep+1) == nil || fb.rekeyRead(^uint32(0)) == nil {
+		panic("epoch too far ahead should be refused")
+	}
+	if fb.rekeyRead(globalRekeyMaxStep) != nil || fb.readEpoch != globalRekeyMaxStep {
+		panic("epoch in one step should be accepted")
+	}
+
+	bd.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestBundleRekeying(t *testing.T) {
+	msgCount := 300
+	received := make(chan []byte, msgCount)
+
+	key := make([]byte, sessionKeyLen)
+	DefaultRNG.Read(key)
+	conns := localConnPairs("127.0.0.1:20016", 2)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0], key: key}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[2], key: key}
+	encryptor := NewChaCha20Poly1305CryptoIO("12345")
+
+	bdS := NewFiberBundle(20, "server", &hsrS)
+	bdC := NewFiberBundle(20, "client", &hsrC)
+	bdS.encryptor = encryptor.Derive(key)
+	bdC.encryptor = encryptor.Derive(key)
+	bdS.SetRekeying(512, 0)
+	bdC.SetRekeying(4096, 0)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+	NewFiber(conns[0], bdS.encryptor, bdS)
+	NewFiber(conns[2], bdC.encryptor, bdC)
+
+	go func() {
+		for i := 0; i < msgCount; i++ {
+			bdC.SendMessage(bytes.Repeat([]byte{byte(i)}, 100+i), PriorityBulk)
+			if i == msgCount/2 {
+				//fiber added later starts from epoch 0
+				NewFiber(conns[1], bdS.encryptor, bdS)
+				NewFiber(conns[3], bdC.encryptor, bdC)
+			}
+		}
+	}()
+	for i := 0; i < msgCount; i++ {
+		select {
+		case x := <-received:
+			if !bytes.Equal(x, bytes.Repeat([]byte{byte(i)}, 100+i)) {
+				panic("message error")
+			}
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+
+	if bdC.writeEpoch() < 10 || bdS.writeEpoch() == 0 {
+		panic("keys should be rotated")
+	}
+	bdC.rekey.lock.Lock()
+	kept := len(bdC.rekey.chains[upload].encryptors)
+	bdC.rekey.lock.Unlock()
+	if kept > 2 {
+		panic("keys of old epochs should be thrown away")
+	}
+	if _, err := bdC.epochEncryptor(upload, 1); err != errStaleEpoch {
+		panic("keys of old epochs should be gone")
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestRekeyLateFiber(t *testing.T) {
+	received := make(chan []byte, 100)
+
+	key := make([]byte, sessionKeyLen)
+	DefaultRNG.Read(key)
+	conns := localConnPairs("127.0.0.1:20019", 2)
+	hsrS := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0], key: key}
+	hsrC := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[2], key: key}
+	encryptor := NewAESGCMCryptoIO("12345")
+
+	bdS := NewFiberBundle(20, "server", &hsrS)
+	bdC := NewFiberBundle(20, "client", &hsrC)
+	bdS.encryptor = encryptor.Derive(key)
+	bdC.encryptor = encryptor.Derive(key)
+	bdS.SetRekeying(64, 0)
+	bdC.SetRekeying(256, 0)
+	bdS.SetOnReceived(func(id uint32, message []byte) {
+		received <- message
+	})
+	NewFiber(conns[0], bdS.encryptor, bdS)
+	oldFiber := NewFiber(conns[2], bdC.encryptor, bdC)
+
+	check := func(i int) {
+		select {
+		case x := <-received:
+			if !bytes.Equal(x, bytes.Repeat([]byte{byte(i)}, 300)) {
+				panic("message error")
+			}
+		case <-time.After(5 * time.Second):
+			panic("no message got and test failed")
+		}
+	}
+
+	i := 0
+	for ; bdC.writeEpoch() <= 2*globalRekeyMaxStep; i++ {
+		bdC.SendMessage(bytes.Repeat([]byte{byte(i)}, 300), PriorityBulk)
+		check(i)
+	}
+
+	//fiber added late jumps to the current epoch, it is the only one left
+	NewFiber(conns[1], bdS.encryptor, bdS)
+	NewFiber(conns[3], bdC.encryptor, bdC)
+	oldFiber.Close(nil)
+	for end := i + 10; i < end; i++ {
+		bdC.SendMessage(bytes.Repeat([]byte{byte(i)}, 300), PriorityBulk)
+		check(i)
+	}
+
+	bdS.Close(nil)
+	bdC.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
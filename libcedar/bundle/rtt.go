@@ -0,0 +1,99 @@
+package bundle
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+rttEstimator estimates round-trip time and computes retransmission timeout (RTO).
+Algorithm is from Jacobson/Karels (RFC 6298):
+
+	SRTT   <- (1 - 1/8) * SRTT + 1/8 * R
+	RTTVAR <- (1 - 1/4) * RTTVAR + 1/4 * |SRTT - R|
+	RTO    <- SRTT + 4 * RTTVAR
+
+RTO is bounded by [globalMinRTO, globalResend].
+*/
+type rttEstimator struct {
+	lock     sync.RWMutex
+	srtt     time.Duration
+	rttvar   time.Duration
+	measured bool
+}
+
+func newRttEstimator() *rttEstimator {
+	ret := new(rttEstimator)
+	ret.measured = false
+	return ret
+}
+
+/*
+update adds a new sample of RTT.
+Samples should be taken only from packets not retransmitted (Karn's algorithm).
+*/
+func (re *rttEstimator) update(sample time.Duration) {
+	if sample <= 0 {
+		sample = time.Microsecond
+	}
+
+	re.lock.Lock()
+	defer re.lock.Unlock()
+
+	if !re.measured {
+		re.srtt = sample
+		re.rttvar = sample / 2
+		re.measured = true
+		return
+	}
+
+	delta := re.srtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+	re.rttvar = (3*re.rttvar + delta) / 4
+	re.srtt = (7*re.srtt + sample) / 8
+}
+
+/*
+hasSample tells if any sample is got.
+*/
+func (re *rttEstimator) hasSample() bool {
+	re.lock.RLock()
+	defer re.lock.RUnlock()
+	return re.measured
+}
+
+/*
+getRTT returns smoothed RTT, or 0 if nothing measured.
+*/
+func (re *rttEstimator) getRTT() time.Duration {
+	re.lock.RLock()
+	defer re.lock.RUnlock()
+	return re.srtt
+}
+
+/*
+getRTO returns current retransmission timeout.
+Before any sample is got, globalInitialRTO is used.
+*/
+func (re *rttEstimator) getRTO() time.Duration {
+	re.lock.RLock()
+	rto := globalInitialRTO
+	if re.measured {
+		rto = re.srtt + 4*re.rttvar
+	}
+	re.lock.RUnlock()
+
+	return boundRTO(rto)
+}
+
+func boundRTO(rto time.Duration) time.Duration {
+	if rto < globalMinRTO {
+		rto = globalMinRTO
+	}
+	if rto > globalResend {
+		rto = globalResend
+	}
+	return rto
+}
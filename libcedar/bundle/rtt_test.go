@@ -0,0 +1,47 @@
+package bundle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRttEstimator(t *testing.T) {
+	re := newRttEstimator()
+
+	if re.hasSample() || re.getRTO() != boundRTO(globalInitialRTO) {
+		panic("initial RTO should be used before any sample")
+	}
+
+	for i := 0; i < 100; i++ {
+		re.update(300 * time.Millisecond)
+	}
+	if re.getRTT() != 300*time.Millisecond {
+		panic("smoothed RTT should converge to samples")
+	}
+	rto := re.getRTO()
+	if rto < 300*time.Millisecond || rto > 400*time.Millisecond {
+		t.Error("RTO =", rto, "(Should be close to RTT on a stable link)")
+	}
+
+	//jittery link gets a larger RTO
+	for i := 0; i < 100; i++ {
+		re.update(time.Duration(100+(i%2)*800) * time.Millisecond)
+	}
+	if re.getRTO() <= rto {
+		panic("RTO should grow with variance")
+	}
+
+	//bounds
+	for i := 0; i < 100; i++ {
+		re.update(time.Microsecond)
+	}
+	if re.getRTO() != globalMinRTO {
+		panic("RTO should not be lower than globalMinRTO")
+	}
+	for i := 0; i < 100; i++ {
+		re.update(time.Hour)
+	}
+	if re.getRTO() != globalResend {
+		panic("RTO should not be higher than globalResend")
+	}
+}
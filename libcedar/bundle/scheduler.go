@@ -0,0 +1,126 @@
+package bundle
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+FiberScheduler chooses a fiber to write on, among living fibers of a bundle.
+For data packets, fibers with full congestion window are not passed to it.
+Fibers passed to Choose are never empty.
+Implementations should be safe for concurrent use, one scheduler may be shared by many bundles.
+*/
+type FiberScheduler interface {
+	Choose(fibers []*Fiber) *Fiber
+}
+
+/*
+RoundRobinScheduler uses fibers one by one.
+*/
+type RoundRobinScheduler struct {
+	next uint32
+}
+
+/*
+NewRoundRobinScheduler creates a new RoundRobinScheduler.
+*/
+func NewRoundRobinScheduler() *RoundRobinScheduler {
+	return new(RoundRobinScheduler)
+}
+
+/*
+Choose returns the next fiber.
+*/
+func (rr *RoundRobinScheduler) Choose(fibers []*Fiber) *Fiber {
+	n := atomic.AddUint32(&rr.next, 1)
+	return fibers[n%uint32(len(fibers))]
+}
+
+/*
+LeastOutstandingScheduler chooses the fiber with least bytes written but not confirmed.
+Ties are broken in round-robin way.
+*/
+type LeastOutstandingScheduler struct {
+	next uint32
+}
+
+/*
+NewLeastOutstandingScheduler creates a new LeastOutstandingScheduler.
+*/
+func NewLeastOutstandingScheduler() *LeastOutstandingScheduler {
+	return new(LeastOutstandingScheduler)
+}
+
+/*
+Choose returns the fiber with least outstanding bytes.
+*/
+func (lo *LeastOutstandingScheduler) Choose(fibers []*Fiber) *Fiber {
+	start := int(atomic.AddUint32(&lo.next, 1) % uint32(len(fibers)))
+
+	ret := fibers[start]
+	least := ret.InFlightBytes()
+	for i := 1; i < len(fibers); i++ {
+		fb := fibers[(start+i)%len(fibers)]
+		if b := fb.InFlightBytes(); b < least {
+			ret, least = fb, b
+		}
+	}
+	return ret
+}
+
+/*
+LatencyWeightedScheduler chooses fibers randomly, with probability inversely proportional to their latency.
+Latency of a fiber is its RTT plus write latency.
+Fibers not measured yet are treated as average ones.
+*/
+type LatencyWeightedScheduler struct {
+}
+
+/*
+NewLatencyWeightedScheduler creates a new LatencyWeightedScheduler.
+*/
+func NewLatencyWeightedScheduler() *LatencyWeightedScheduler {
+	return new(LatencyWeightedScheduler)
+}
+
+/*
+Choose returns a fiber, faster ones are more likely to be chosen.
+*/
+func (lw *LatencyWeightedScheduler) Choose(fibers []*Fiber) *Fiber {
+	latency := make([]time.Duration, len(fibers))
+	total, measured := time.Duration(0), 0
+	for i, fb := range fibers {
+		if fb.rtt.hasSample() {
+			latency[i] = fb.RTT() + fb.WriteLatency()
+			if latency[i] <= 0 {
+				latency[i] = time.Microsecond
+			}
+			total += latency[i]
+			measured++
+		}
+	}
+	if measured == 0 {
+		return fibers[DefaultRNG.Uint32()%uint32(len(fibers))]
+	}
+
+	average := total / time.Duration(measured)
+	weights := make([]float64, len(fibers))
+	sum := 0.0
+	for i := range fibers {
+		if latency[i] == 0 {
+			latency[i] = average
+		}
+		weights[i] = 1.0 / float64(latency[i])
+		sum += weights[i]
+	}
+
+	r := float64(DefaultRNG.Uint32()) / float64(1<<32) * sum
+	for i, w := range weights {
+		if r < w {
+			return fibers[i]
+		}
+		r -= w
+	}
+	return fibers[len(fibers)-1]
+}
@@ -0,0 +1,61 @@
+package bundle
+
+import (
+	"testing"
+	"time"
+)
+
+func newStatsFiber(inFlightBytes int64, rtt time.Duration) *Fiber {
+	fb := new(Fiber)
+	fb.rtt = newRttEstimator()
+	if rtt > 0 {
+		fb.rtt.update(rtt)
+	}
+	fb.addInFlight(1, inFlightBytes)
+	return fb
+}
+
+func TestRoundRobinScheduler(t *testing.T) {
+	fibers := []*Fiber{newStatsFiber(0, 0), newStatsFiber(0, 0), newStatsFiber(0, 0)}
+	s := NewRoundRobinScheduler()
+
+	counts := make(map[*Fiber]int)
+	for i := 0; i < 30; i++ {
+		counts[s.Choose(fibers)]++
+	}
+	for _, fb := range fibers {
+		if counts[fb] != 10 {
+			panic("round robin should use fibers equally")
+		}
+	}
+}
+
+func TestLeastOutstandingScheduler(t *testing.T) {
+	fibers := []*Fiber{newStatsFiber(3000, 0), newStatsFiber(100, 0), newStatsFiber(2000, 0)}
+	s := NewLeastOutstandingScheduler()
+
+	for i := 0; i < 10; i++ {
+		if s.Choose(fibers) != fibers[1] {
+			panic("fiber with least outstanding bytes should be chosen")
+		}
+	}
+}
+
+func TestLatencyWeightedScheduler(t *testing.T) {
+	fast := newStatsFiber(0, 10*time.Millisecond)
+	slow := newStatsFiber(0, 1000*time.Millisecond)
+	unknown := newStatsFiber(0, 0)
+	fibers := []*Fiber{slow, fast, unknown}
+	s := NewLatencyWeightedScheduler()
+
+	counts := make(map[*Fiber]int)
+	for i := 0; i < 10000; i++ {
+		counts[s.Choose(fibers)]++
+	}
+	if counts[fast] < counts[unknown] || counts[unknown] < counts[slow] {
+		t.Error("fast =", counts[fast], "unknown =", counts[unknown], "slow =", counts[slow])
+	}
+	if counts[fast] < 10*counts[slow] {
+		t.Error("fast =", counts[fast], "slow =", counts[slow], "(Should be about 100 times)")
+	}
+}
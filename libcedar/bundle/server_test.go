@@ -90,7 +90,7 @@ func callbackClt(id uint32, message []byte) {
 }
 
 func StartServer() {
-	sv := NewEndpoint(500, "server", serverAddr, "test")
+	sv := NewEndpoint(500, "server", serverAddr, "test", CipherAESGCM)
 	sv.SetOnReceived(callbackSvr)
 	go sv.ServerStart()
 
@@ -107,7 +107,7 @@ func StartServer() {
 		fi.Read(buf)
 
 		for id := range hashersSvr {
-			sv.Write(id, buf)
+			sv.Write(id, buf, PriorityBulk)
 		}
 	}
 }
@@ -116,7 +116,7 @@ func StartClient() {
 	clts := make([]*Endpoint, 0)
 
 	for i := 0; i < numOfClients; i++ {
-		clt := NewEndpoint(500, "client", serverAddr, "test")
+		clt := NewEndpoint(500, "client", serverAddr, "test", CipherAESGCM)
 		clt.SetOnReceived(callbackClt)
 		clt.CreateConnection(10)
 		clts = append(clts, clt)
@@ -133,7 +133,7 @@ func StartClient() {
 		fi.Read(buf)
 
 		for i := 0; i < numOfClients; i++ {
-			clts[i].Write(0, buf)
+			clts[i].Write(0, buf, PriorityBulk)
 		}
 	}
 
@@ -0,0 +1,106 @@
+package bundle
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+FiberShaping limits the writing rate of each fiber, to stay under per-connection limits of ISPs.
+Rate is the target rate in bytes per second, 0 means unlimited.
+The rate is randomly changed in [Rate*(1-Jitter), Rate*(1+Jitter)] every globalJitterPeriod,
+so that the traffic does not look constant. It never exceeds MaxRate (Rate if MaxRate is 0).
+*/
+type FiberShaping struct {
+	Rate    int64
+	MaxRate int64
+	Jitter  float64
+}
+
+/*
+tokenBucket shapes writing of one fiber.
+Tokens are bytes. Writing is allowed to take tokens in advance (debt), and waits until the debt is paid.
+*/
+type tokenBucket struct {
+	lock     sync.Mutex
+	shaping  FiberShaping
+	rate     float64 //current rate, with jitter
+	burst    float64
+	tokens   float64
+	last     time.Time
+	rerateAt time.Time
+}
+
+func newTokenBucket(shaping FiberShaping, now time.Time) *tokenBucket {
+	if shaping.MaxRate <= 0 || shaping.MaxRate < shaping.Rate {
+		shaping.MaxRate = shaping.Rate
+	}
+	if shaping.Jitter < 0 {
+		shaping.Jitter = 0
+	}
+	if shaping.Jitter > 1 {
+		shaping.Jitter = 1
+	}
+
+	ret := new(tokenBucket)
+	ret.shaping = shaping
+	ret.burst = float64(shaping.MaxRate) * globalShapingBurst.Seconds()
+	ret.tokens = ret.burst
+	ret.last = now
+	ret.rerate(now)
+	return ret
+}
+
+/*
+rerate picks a new rate with jitter. lock should be held.
+*/
+func (tb *tokenBucket) rerate(now time.Time) {
+	r := float64(DefaultRNG.Uint32())/float64(1<<32)*2 - 1
+	tb.rate = float64(tb.shaping.Rate) * (1 + tb.shaping.Jitter*r)
+	if tb.rate > float64(tb.shaping.MaxRate) {
+		tb.rate = float64(tb.shaping.MaxRate)
+	}
+	tb.rerateAt = now.Add(globalJitterPeriod)
+}
+
+/*
+refill adds tokens generated since last time. lock should be held.
+*/
+func (tb *tokenBucket) refill(now time.Time) {
+	if now.After(tb.rerateAt) {
+		tb.rerate(now)
+	}
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+}
+
+/*
+take takes n tokens, and returns how long to wait before writing them.
+*/
+func (tb *tokenBucket) take(n int, now time.Time) time.Duration {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill(now)
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 || tb.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+/*
+exhausted tells if writing has to wait for tokens now.
+*/
+func (tb *tokenBucket) exhausted(now time.Time) bool {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	tb.refill(now)
+	return tb.tokens <= 0
+}
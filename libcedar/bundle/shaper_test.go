@@ -0,0 +1,82 @@
+package bundle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(FiberShaping{Rate: 1000, MaxRate: 1100, Jitter: 0.5}, now)
+
+	for i := 0; i < 100; i++ {
+		tb.rerate(now)
+		if tb.rate < 500 || tb.rate > 1100 {
+			panic("rate with jitter out of bounds")
+		}
+	}
+
+	//burst is used first
+	tb.rate = 1000
+	tb.rerateAt = now.Add(time.Hour)
+	burst := int(tb.tokens)
+	if tb.take(burst, now) != 0 {
+		panic("burst should be written at once")
+	}
+	if !tb.exhausted(now) {
+		panic("bucket should be exhausted")
+	}
+
+	//debt is paid by time
+	if wait := tb.take(500, now); wait != 500*time.Millisecond {
+		t.Error("Wait:", wait, "(Should be 500ms)")
+	}
+	if tb.exhausted(now.Add(400*time.Millisecond)) == false {
+		panic("debt is not paid yet")
+	}
+	if tb.exhausted(now.Add(600 * time.Millisecond)) {
+		panic("debt should be paid")
+	}
+}
+
+func TestFiberShaping(t *testing.T) {
+	conns := localConnPairs("127.0.0.1:20010", 1)
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000, conn: conns[0]}
+	encryptor := NewCedarCryptoIO("12345")
+
+	rate := int64(1024 * 1024)
+	bd := NewFiberBundle(10, "server", &hsr)
+	bd.SetShaping(FiberShaping{Rate: rate})
+	fb := NewFiber(conns[0], encryptor, bd)
+
+	count, size := 100, 4096
+	go func() {
+		msg := make([]byte, size)
+		for i := 0; i < count; i++ {
+			fb.write(FiberPacket{uint32(i), typeSendData, msg}, PriorityBulk)
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < count; {
+		msg, err := encryptor.ReadPacket(conns[1])
+		if err != nil {
+			panic("read error")
+		}
+		if fb.unpack(msg).msgType == typeSendData {
+			i++
+		}
+	}
+	used := time.Since(start)
+	expected := time.Duration(float64(count*size)/float64(rate)*float64(time.Second)) - globalShapingBurst
+	if used < expected*8/10 {
+		panic("rate limit exceeded")
+	}
+	if used > expected*2 {
+		t.Error("Time used:", used, "(Expected:", expected, ")")
+	}
+
+	bd.Close(nil)
+	conns[1].Close()
+	time.Sleep(100 * time.Millisecond)
+}
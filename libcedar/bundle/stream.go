@@ -0,0 +1,128 @@
+package bundle
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+)
+
+var errIllegalStream = errors.New("illegal stream header")
+
+/*
+Data packets carry a stream header before the message:
+
+	[stream 4B][after 4B][flags 1B][message xB]
+
+after is how many IDs back the previous packet of the same stream is, which must be forwarded first.
+0 means there is no such packet not confirmed, so it could be forwarded at once.
+Packets of different streams do not wait for each other.
+*/
+const streamHeaderLen = 9
+
+const (
+	flagMoreFragments byte = 0x01 //message continues in the next packet of the same stream and priority
+	flagPriorityMask  byte = 0x06 //priority of the message, fragments of different priorities might be interleaved
+	flagPriorityShift      = 1
+)
+
+/*
+streamMessage adds stream header to msg.
+*/
+func streamMessage(stream uint32, after uint32, flags byte, msg []byte) []byte {
+	ret := make([]byte, streamHeaderLen+len(msg))
+	putStreamHeader(ret, stream, after, flags)
+	copy(ret[streamHeaderLen:], msg)
+	return ret
+}
+
+/*
+putStreamHeader writes stream header in the space reserved at the beginning of buf.
+*/
+func putStreamHeader(buf []byte, stream uint32, after uint32, flags byte) {
+	binary.BigEndian.PutUint32(buf[0:4], stream)
+	binary.BigEndian.PutUint32(buf[4:8], after)
+	buf[8] = flags
+}
+
+/*
+parseStreamMessage splits stream header and message.
+*/
+func parseStreamMessage(msg []byte) (stream uint32, after uint32, flags byte, body []byte, err error) {
+	if len(msg) < streamHeaderLen {
+		return 0, 0, 0, nil, errIllegalStream
+	}
+	stream = binary.BigEndian.Uint32(msg[0:4])
+	after = binary.BigEndian.Uint32(msg[4:8])
+	return stream, after, msg[8], msg[streamHeaderLen:], nil
+}
+
+/*
+nextInStream returns how many IDs back the previous packet of stream is, for packet id.
+It also records id as the last one of stream. sendLock should be held.
+*/
+func (bd *FiberBundle) nextInStream(stream uint32, id uint32) uint32 {
+	after := uint32(0)
+	if last, ok := bd.streamLast[stream]; ok && !seqBefore(last, bd.sendBase) {
+		after = id - last
+	}
+	bd.streamLast[stream] = id
+
+	//streams with everything confirmed are forgotten from time to time
+	if len(bd.streamLast) > bd.streamSweep {
+		for s, last := range bd.streamLast {
+			if seqBefore(last, bd.sendBase) {
+				delete(bd.streamLast, s)
+			}
+		}
+		bd.streamSweep = 2*len(bd.streamLast) + 64
+	}
+	return after
+}
+
+/*
+isForwarded tells if packet id has been forwarded. receiveLock should be held.
+*/
+func (bd *FiberBundle) isForwarded(id uint32) bool {
+	if seqBefore(id, atomic.LoadUint32(&bd.seqs[download])) {
+		return true
+	}
+	_, ok := bd.forwarded[id]
+	return ok
+}
+
+/*
+streamPacketReceived decides when a new packet in receiveBuffer could be forwarded.
+receiveLock should be held.
+*/
+func (bd *FiberBundle) streamPacketReceived(id uint32, after uint32) {
+	if after == 0 || bd.isForwarded(id-after) {
+		bd.ready = append(bd.ready, id)
+	} else {
+		bd.waiting[id-after] = id
+	}
+}
+
+/*
+markForwarded records packet id as forwarded, and makes the next packet of its stream ready.
+seqs[download] moves when there is no gap before it. receiveLock should be held.
+*/
+func (bd *FiberBundle) markForwarded(id uint32) {
+	if id == atomic.LoadUint32(&bd.seqs[download]) {
+		next := id + 1
+		for {
+			if _, ok := bd.forwarded[next]; !ok {
+				break
+			}
+			delete(bd.forwarded, next)
+			next++
+		}
+		atomic.StoreUint32(&bd.seqs[download], next)
+	} else {
+		bd.forwarded[id] = empty{}
+	}
+
+	if next, ok := bd.waiting[id]; ok {
+		delete(bd.waiting, id)
+		bd.ready = append(bd.ready, next)
+	}
+}
@@ -0,0 +1,61 @@
+package bundle
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBundleStreams(t *testing.T) {
+	hsr := HandshakeResult{id: magicID, idS2C: 1000000, idC2S: 4000000}
+	bd := NewFiberBundle(50, "server", &hsr)
+	received := make(chan string, 20)
+	bd.SetOnReceived(func(id uint32, message []byte) {
+		received <- string(message)
+	})
+
+	first := uint32(4000000)
+	send := func(i uint32, stream uint32, after uint32, msg string) {
+		bd.PacketReceived(&FiberPacket{first + i, typeSendData, streamMessage(stream, after, 0, []byte(msg))})
+	}
+	expect := func(msgs ...string) {
+		for _, m := range msgs {
+			select {
+			case x := <-received:
+				if x != m {
+					panic("message error")
+				}
+			case <-time.After(time.Second):
+				panic("no message got and test failed")
+			}
+		}
+		select {
+		case <-received:
+			panic("message should not be forwarded yet")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	//0 of stream 1 is lost, stream 2 should not wait for it
+	send(1, 1, 1, "a1")
+	send(2, 2, 0, "b0")
+	send(3, 2, 1, "b1")
+	expect("b0", "b1")
+	if atomic.LoadUint32(&bd.seqs[download]) != first {
+		panic("cumulative ID should wait for the lost one")
+	}
+
+	//duplicated ones are not forwarded again
+	send(3, 2, 1, "b1")
+	expect()
+
+	send(0, 1, 0, "a0")
+	send(4, 1, 3, "a2")
+	expect("a0", "a1", "a2")
+	if atomic.LoadUint32(&bd.seqs[download]) != first+5 {
+		panic("cumulative ID should move over forwarded ones")
+	}
+
+	bd.Close(nil)
+	time.Sleep(100 * time.Millisecond)
+}
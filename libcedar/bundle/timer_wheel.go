@@ -0,0 +1,91 @@
+package bundle
+
+import (
+	"time"
+)
+
+type wheelEntry struct {
+	pending  *pendingPacket
+	deadline time.Time
+}
+
+/*
+timerWheel is a hashed timing wheel for retransmission timers.
+Each slot covers one tick, timers later than one round stay in their slot until due.
+It is not thread safe, only the sender loop of a bundle uses it.
+*/
+type timerWheel struct {
+	tick    time.Duration
+	slots   [][]wheelEntry
+	current int
+	last    time.Time
+	count   int
+}
+
+func newTimerWheel(tick time.Duration, size int, now time.Time) *timerWheel {
+	ret := new(timerWheel)
+	ret.tick = tick
+	ret.slots = make([][]wheelEntry, size)
+	ret.current = 0
+	ret.last = now
+	ret.count = 0
+	return ret
+}
+
+/*
+add adds a timer which fires at deadline.
+*/
+func (tw *timerWheel) add(p *pendingPacket, deadline time.Time) {
+	//round up, so the slot is not visited before deadline
+	ticks := int((deadline.Sub(tw.last) + tw.tick - 1) / tw.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	i := (tw.current + ticks) % len(tw.slots)
+	tw.slots[i] = append(tw.slots[i], wheelEntry{p, deadline})
+	tw.count++
+}
+
+/*
+advance moves the wheel to now, and returns timers due.
+Timers are returned in order of slots, stale ones are returned as well (caller should check).
+*/
+func (tw *timerWheel) advance(now time.Time) []wheelEntry {
+	ticks := int(now.Sub(tw.last) / tw.tick)
+	if ticks <= 0 {
+		return nil
+	}
+	tw.last = tw.last.Add(time.Duration(ticks) * tw.tick)
+	if ticks > len(tw.slots) {
+		ticks = len(tw.slots)
+	}
+
+	var ret []wheelEntry
+	for t := 0; t < ticks; t++ {
+		tw.current = (tw.current + 1) % len(tw.slots)
+		slot := tw.slots[tw.current]
+		kept := slot[:0]
+		for _, e := range slot {
+			if e.deadline.After(now) {
+				kept = append(kept, e)
+			} else {
+				ret = append(ret, e)
+			}
+		}
+		//clear references for GC
+		for i := len(kept); i < len(slot); i++ {
+			slot[i] = wheelEntry{}
+		}
+		tw.slots[tw.current] = kept
+	}
+	tw.count -= len(ret)
+
+	return ret
+}
+
+/*
+size returns number of timers in the wheel.
+*/
+func (tw *timerWheel) size() int {
+	return tw.count
+}
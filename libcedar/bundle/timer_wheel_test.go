@@ -0,0 +1,46 @@
+package bundle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	start := time.Now()
+	tick := 10 * time.Millisecond
+	wheel := newTimerWheel(tick, 8, start)
+
+	//deadlines in ms, some are later than one round of the wheel
+	deadlines := []int{5, 10, 15, 30, 79, 80, 95, 200}
+	for _, d := range deadlines {
+		p := &pendingPacket{pkt: FiberPacket{uint32(d), typeSendData, nil}}
+		wheel.add(p, start.Add(time.Duration(d)*time.Millisecond))
+	}
+	if wheel.size() != len(deadlines) {
+		panic("size of wheel error")
+	}
+
+	fired := 0
+	for now := 0; now <= 300; now++ {
+		for _, e := range wheel.advance(start.Add(time.Duration(now) * time.Millisecond)) {
+			d := int(e.pending.pkt.id)
+			if d > now {
+				panic("timer fired before deadline")
+			}
+			if now-d >= int(tick/time.Millisecond) {
+				panic("timer fired too late")
+			}
+			fired++
+		}
+	}
+	if fired != len(deadlines) || wheel.size() != 0 {
+		panic("all timers should be fired")
+	}
+
+	//long pause, all fired at once
+	wheel.add(&pendingPacket{}, start.Add(400*time.Millisecond))
+	wheel.add(&pendingPacket{}, start.Add(1000*time.Millisecond))
+	if len(wheel.advance(start.Add(5*time.Second))) != 2 {
+		panic("timers should be fired after a long pause")
+	}
+}
@@ -0,0 +1,86 @@
+package bundle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+/*
+Users of a multi-user server, each with an ID and a secret.
+Client of a user takes the secret as password, and sends a tag of the user before each request:
+
+	[nonce 16B][HMAC-SHA256 of nonce 32B]
+
+HMAC is by a key from the ID and the secret, so that the ID is never on the wire, and tags of a user could not be linked.
+The tag looks random, as the request after it. Server finds the user by keys of all users.
+Requests without a tag, or of no user, are refused.
+*/
+const (
+	userNonceLen = 16
+	userTagLen   = userNonceLen + sha256.Size
+)
+
+/*
+userKey returns key of tags of user id, from secret by kdf.
+*/
+func userKey(kdf KDF, id string, secret string) []byte {
+	return kdf.Generate(secret, "cedar/user/"+id, 256)
+}
+
+/*
+newUserTag returns a tag by key, with a new nonce.
+*/
+func newUserTag(key []byte) []byte {
+	tag := make([]byte, userNonceLen, userTagLen)
+	DefaultRNG.Read(tag)
+	return append(tag, handshakeProof(key, tag)...)
+}
+
+type userEntry struct {
+	id        string
+	key       []byte   //of tags
+	encryptor CryptoIO //of requests
+}
+
+/*
+userTable finds users of requests by their tags.
+Keys of all users are generated when it is created, for each KDF accepted, since a KDF may be slow.
+*/
+type userTable struct {
+	entries []userEntry
+}
+
+func newUserTable(secrets map[string]string, kdfs []KDF, newEncryptor func(string, KDF) CryptoIO) *userTable {
+	ret := new(userTable)
+	ret.entries = make([]userEntry, 0, len(secrets)*len(kdfs))
+	for _, kdf := range kdfs {
+		for id, secret := range secrets {
+			ret.entries = append(ret.entries, userEntry{id, userKey(kdf, id, secret), newEncryptor(secret, kdf)})
+		}
+	}
+
+	return ret
+}
+
+/*
+find returns ID of the user of tag, and encryptor of its requests.
+All entries are checked, so that time taken does not tell where the user is.
+*/
+func (ut *userTable) find(tag []byte) (string, CryptoIO, bool) {
+	if len(tag) != userTagLen {
+		return "", nil, false
+	}
+	nonce := tag[:userNonceLen]
+	mac := tag[userNonceLen:]
+
+	found := -1
+	for i, e := range ut.entries {
+		if hmac.Equal(mac, handshakeProof(e.key, nonce)) && found < 0 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return "", nil, false
+	}
+	return ut.entries[found].id, ut.entries[found].encryptor, true
+}
@@ -15,18 +15,23 @@ var debugVerbose = 0
 
 func innerLog(level int, a ...interface{}) {
 	if debugVerbose >= level {
-		log.Println(a)
+		log.Println(a...)
 	}
 }
 
 //LogDebug prints info
 func LogDebug(a ...interface{}) {
-	innerLog(10, a)
+	innerLog(10, a...)
+}
+
+//debugging tells if LogDebug prints, so that hot paths could skip it
+func debugging() bool {
+	return debugVerbose >= 10
 }
 
 //LogInfo prints info
 func LogInfo(a ...interface{}) {
-	innerLog(0, a)
+	innerLog(0, a...)
 }
 
 func inRange(seq, start, end uint32) bool {
@@ -37,6 +42,13 @@ func inRange(seq, start, end uint32) bool {
 	return (seq >= start) || (seq < end)
 }
 
+/*
+seqBefore tells whether seq a is before seq b, considering overflow.
+*/
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
 func (bd *FiberBundle) seqCheck(packetId uint32) int {
 	seqA := atomic.LoadUint32(&bd.seqs[download])
 	seqB := seqA + bd.bufferLen
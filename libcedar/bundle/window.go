@@ -0,0 +1,90 @@
+package bundle
+
+import (
+	"math"
+	"time"
+)
+
+/*
+windowSizer decides the sending window of a bundle from its bandwidth-delay product (BDP).
+Bandwidth is measured from packets delivered during the last interval (at least one RTT),
+delay is the min RTT seen recently, plus globalConfirmWait as acknowledgements may be delayed. Window is globalWindowGain times of BDP, bounded by [minLen, maxLen].
+
+When the window itself is the bottleneck, measured BDP equals the window, so the window grows by
+globalWindowGain each interval until the link (or maxLen) limits it.
+It is not thread safe, sendLock of the bundle protects it.
+*/
+type windowSizer struct {
+	minLen uint32
+	maxLen uint32
+	window uint32
+
+	delivered uint32 //packets delivered since last sample
+	since     time.Time
+	minRTT    time.Duration
+	minRTTAt  time.Time
+}
+
+func newWindowSizer(minLen uint32, maxLen uint32, now time.Time) *windowSizer {
+	if minLen < 1 {
+		minLen = 1
+	}
+	if maxLen < minLen {
+		maxLen = minLen
+	}
+
+	ret := new(windowSizer)
+	ret.minLen = minLen
+	ret.maxLen = maxLen
+	ret.window = minLen
+	ret.delivered = 0
+	ret.since = now
+	ret.minRTT = 0
+	return ret
+}
+
+/*
+addRTT adds a sample of RTT.
+*/
+func (ws *windowSizer) addRTT(sample time.Duration, now time.Time) {
+	if ws.minRTT == 0 || sample < ws.minRTT || now.Sub(ws.minRTTAt) > globalMinRTTExpire {
+		ws.minRTT = sample
+		ws.minRTTAt = now
+	}
+}
+
+/*
+addDelivered records that n more packets are delivered, and returns the new window.
+srtt is the smoothed RTT, which decides length of the interval.
+*/
+func (ws *windowSizer) addDelivered(n uint32, now time.Time, srtt time.Duration) uint32 {
+	ws.delivered += n
+	if ws.minRTT == 0 {
+		return ws.window
+	}
+
+	interval := srtt
+	if interval < globalWindowInterval {
+		interval = globalWindowInterval
+	}
+	elapsed := now.Sub(ws.since)
+	if elapsed < interval {
+		return ws.window
+	}
+
+	delay := ws.minRTT + globalConfirmWait
+	bdp := float64(ws.delivered) / elapsed.Seconds() * delay.Seconds()
+	target := math.Ceil(bdp * globalWindowGain)
+	if target < float64(ws.minLen) {
+		target = float64(ws.minLen)
+	}
+	if target > float64(ws.maxLen) {
+		target = float64(ws.maxLen)
+	}
+	ws.window = uint32(target)
+	LogDebug("[windowSizer.addDelivered]", ws.delivered, elapsed, ws.minRTT, ws.window)
+
+	ws.delivered = 0
+	ws.since = now
+	return ws.window
+}
@@ -0,0 +1,58 @@
+package bundle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowSizer(t *testing.T) {
+	now := time.Now()
+	ws := newWindowSizer(2, 100, now)
+
+	//no RTT measured, window is kept
+	if ws.addDelivered(10, now.Add(time.Second), 0) != 2 {
+		panic("window should not change before RTT measured")
+	}
+
+	//delay is 50ms with globalConfirmWait
+	ws.addRTT(50*time.Millisecond-globalConfirmWait, now)
+	ws.addRTT(time.Second, now)
+	if ws.minRTT != 50*time.Millisecond-globalConfirmWait {
+		panic("min RTT error")
+	}
+
+	//window is the bottleneck: it grows until max
+	last := ws.window
+	for i := 0; i < 10; i++ {
+		now = now.Add(50 * time.Millisecond)
+		w := ws.addDelivered(ws.window, now, 50*time.Millisecond)
+		if w < last {
+			panic("window should grow")
+		}
+		last = w
+	}
+	if last != 100 {
+		t.Error("Window:", last, "(Should reach max)")
+	}
+
+	//link is the bottleneck: 10 packets per RTT
+	for i := 0; i < 5; i++ {
+		now = now.Add(50 * time.Millisecond)
+		ws.addDelivered(10, now, 50*time.Millisecond)
+	}
+	if ws.window != 20 {
+		t.Error("Window:", ws.window, "(Should be 2 * BDP)")
+	}
+
+	//nearly idle
+	now = now.Add(time.Second)
+	if ws.addDelivered(1, now, 50*time.Millisecond) != 2 {
+		panic("window should shrink to min")
+	}
+
+	//samples are taken once per interval
+	now = now.Add(10 * time.Millisecond)
+	if ws.addDelivered(100, now, 50*time.Millisecond) != 2 {
+		panic("window should not change within interval")
+	}
+}
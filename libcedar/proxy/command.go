@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"github.com/OliverQin/cedar/libcedar/bundle"
+	"github.com/OliverQin/cedar/libcedar/socks"
+)
+
+/*
+commandPriority returns priority to send a SOCKS command through the tunnel.
+Commands of one connection must keep their order, so only commands creating connections go first.
+*/
+func commandPriority(msg []byte) bundle.Priority {
+	if socks.IsConnectCommand(msg) {
+		return bundle.PriorityInteractive
+	}
+	return bundle.PriorityBulk
+}
+
+/*
+commandStream returns the stream to send a SOCKS command on, one for each connection,
+so that data lost for one connection does not hold back others.
+*/
+func commandStream(msg []byte) uint32 {
+	return uint32(socks.CommandConnection(msg))
+}
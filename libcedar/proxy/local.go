@@ -10,9 +10,9 @@ type ProxyLocal struct {
 	client *socks.Endpoint
 }
 
-func NewProxyLocal(password string, remote string, local string, bufferSize int) *ProxyLocal {
+func NewProxyLocal(password string, cipherName string, remote string, local string, bufferSize int) *ProxyLocal {
 	ret := new(ProxyLocal)
-	ret.tunnel = bundle.NewEndpoint(uint32(bufferSize), "client", remote, password)
+	ret.tunnel = bundle.NewEndpoint(uint32(bufferSize), "client", remote, password, cipherName)
 	ret.client = socks.NewClient(local)
 
 	remoteToSocks := func(id uint32, msg []byte) {
@@ -20,7 +20,7 @@ func NewProxyLocal(password string, remote string, local string, bufferSize int)
 	}
 
 	socksToRemote := func(msg []byte) error {
-		ret.tunnel.Write(0, msg)
+		ret.tunnel.WriteStream(0, commandStream(msg), msg, commandPriority(msg))
 		return nil //TODO: signature not good, add error
 	}
 
@@ -35,6 +35,39 @@ func NewProxyLocal(password string, remote string, local string, bufferSize int)
 	return ret
 }
 
+/*
+SetAutoBuffer makes number of buffers adjusted automatically, between minBufferSize and bufferSize.
+It should be called before Run.
+*/
+func (pl *ProxyLocal) SetAutoBuffer(minBufferSize int) {
+	pl.tunnel.SetAutoWindow(uint32(minBufferSize))
+}
+
+/*
+SetKDF sets KDF of keys from password, see bundle.Endpoint.SetKDF.
+It should be called before Run.
+*/
+func (pl *ProxyLocal) SetKDF(kdfs ...bundle.KDF) {
+	pl.tunnel.SetKDF(kdfs...)
+}
+
+/*
+SetUser connects to a multi-user server as user id, whose secret is the password, see bundle.Endpoint.SetUser.
+It should be called before Run.
+*/
+func (pl *ProxyLocal) SetUser(id string) {
+	pl.tunnel.SetUser(id)
+}
+
+/*
+SetRateLimit limits the rate of each TCP connection, in bytes per second.
+Rate is changed randomly by jitter (0 to 1), but never exceeds maxRate.
+It should be called before Run.
+*/
+func (pl *ProxyLocal) SetRateLimit(rate int64, maxRate int64, jitter float64) {
+	pl.tunnel.SetShaping(bundle.FiberShaping{Rate: rate, MaxRate: maxRate, Jitter: jitter})
+}
+
 func (pl *ProxyLocal) Run(numOfConns int) {
 	pl.tunnel.CreateConnection(numOfConns)
 
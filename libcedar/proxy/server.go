@@ -13,11 +13,11 @@ type ProxyServer struct {
 	tunnel  *bundle.Endpoint
 }
 
-func NewProxyServer(password string, local string, bufferSize int) *ProxyServer {
+func NewProxyServer(password string, cipherName string, local string, bufferSize int) *ProxyServer {
 	ret := new(ProxyServer)
 
 	ret.servers = make(map[uint32]*socks.Endpoint)
-	ret.tunnel = bundle.NewEndpoint(uint32(bufferSize), "server", local, password)
+	ret.tunnel = bundle.NewEndpoint(uint32(bufferSize), "server", local, password, cipherName)
 	ret.tunnel.SetOnReceived(ret.serverToSocks)
 	ret.tunnel.SetOnBundleLost(ret.bundleLost)
 
@@ -49,15 +49,52 @@ func (ps *ProxyServer) serverToSocks(id uint32, msg []byte) {
 		ps.mapLock.Unlock()
 
 		socksToServer := func(msg []byte) error {
-			ps.tunnel.Write(id, msg)
+			ps.tunnel.WriteStream(id, commandStream(msg), msg, commandPriority(msg))
 			return nil
 		}
 		sv.OnCommandGenerated = socksToServer
+
+		if user := ps.tunnel.BundleUser(id); user != "" {
+			bundle.LogInfo("[ProxyServer.newBundle]", id, "of user", user)
+		}
 	}
 
 	sv.WriteCommand(msg)
 }
 
+/*
+SetAutoBuffer makes number of buffers adjusted automatically, between minBufferSize and bufferSize.
+It should be called before Run.
+*/
+func (ps *ProxyServer) SetAutoBuffer(minBufferSize int) {
+	ps.tunnel.SetAutoWindow(uint32(minBufferSize))
+}
+
+/*
+SetKDF sets KDF of keys from password, see bundle.Endpoint.SetKDF.
+It should be called before Run.
+*/
+func (ps *ProxyServer) SetKDF(kdfs ...bundle.KDF) {
+	ps.tunnel.SetKDF(kdfs...)
+}
+
+/*
+SetUsers makes the server multi-user, with secrets of users by their IDs, see bundle.Endpoint.SetUsers.
+It should be called before Run.
+*/
+func (ps *ProxyServer) SetUsers(users map[string]string) {
+	ps.tunnel.SetUsers(users)
+}
+
+/*
+SetRateLimit limits the rate of each TCP connection, in bytes per second.
+Rate is changed randomly by jitter (0 to 1), but never exceeds maxRate.
+It should be called before Run.
+*/
+func (ps *ProxyServer) SetRateLimit(rate int64, maxRate int64, jitter float64) {
+	ps.tunnel.SetShaping(bundle.FiberShaping{Rate: rate, MaxRate: maxRate, Jitter: jitter})
+}
+
 /*
 Run is an endless loop to run the server
 */
@@ -35,6 +35,7 @@ import (
 CommandGeneratedFunc is type of the callback function.
 The function is called when an endpoint generates command.
 This would happen right after data received, connection lost, connection created, etc.
+The command is only valid during the call, it should be copied if it is kept.
 */
 type CommandGeneratedFunc (func([]byte) error)
 
@@ -136,6 +137,25 @@ Protocol:
     [cmdClose   1B][id 2B]
 */
 
+/*
+IsConnectCommand tells if msg is a command creating a connection.
+Nothing of the connection is generated before it, so it could be fetched ahead of other commands.
+*/
+func IsConnectCommand(msg []byte) bool {
+	return len(msg) > 0 && (msg[0] == cmdConnectTCP || msg[0] == cmdConnectUDP)
+}
+
+/*
+CommandConnection returns ID of the connection msg is for.
+Commands of different connections do not depend on each other.
+*/
+func CommandConnection(msg []byte) uint16 {
+	if len(msg) < 3 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(msg[1:3])
+}
+
 func (edp *Endpoint) yield(msg []byte) error {
 	if edp.OnCommandGenerated != nil {
 		(edp.OnCommandGenerated)(msg)
@@ -144,9 +164,9 @@ func (edp *Endpoint) yield(msg []byte) error {
 }
 
 func (edp *Endpoint) keepReading(conn net.Conn, id uint16) {
+	//command is only valid during the callback, so the buffer is reused
+	buf := make([]byte, edp.config.BufferLength+3)
 	for {
-		buf := make([]byte, edp.config.BufferLength+3)
-
 		n, err := conn.Read(buf[3:])
 		buf[0] = cmdSend
 		binary.BigEndian.PutUint16(buf[1:3], id)